@@ -0,0 +1,497 @@
+package helpers
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	BlockRuleExact     = "exact"
+	BlockRulePrefix    = "prefix"
+	BlockRuleAnonymous = "anonymous"
+)
+
+const (
+	BlockActionBlock = "block"
+	BlockActionAllow = "allow"
+)
+
+const blocklistChannel = "blocklist_changed"
+
+const defaultBlocklistTTL = 5 * time.Minute
+
+// caller ids that mean the number was withheld
+var anonymousCallerIds = map[string]bool{
+	"":            true,
+	"anonymous":   true,
+	"restricted":  true,
+	"private":     true,
+	"withheld":    true,
+	"unknown":     true,
+	"unavailable": true,
+}
+
+type BlockRule struct {
+	Id          int `json:"id"`
+	WorkspaceId int `json:"workspace_id"`
+	// Number is an E.164 number for exact rules and a leading part of one for prefix rules
+	Number    string     `json:"number"`
+	Type      string     `json:"type"`
+	Action    string     `json:"action"`
+	Note      string     `json:"note"`
+	StartsAt  *time.Time `json:"starts_at"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+func (rule *BlockRule) IsActive(now time.Time) bool {
+	if rule.StartsAt != nil && now.Before(*rule.StartsAt) {
+		return false
+	}
+	if rule.ExpiresAt != nil && !now.Before(*rule.ExpiresAt) {
+		return false
+	}
+	return true
+}
+
+func (rule *BlockRule) validate() error {
+	switch rule.Type {
+	case BlockRuleExact, BlockRulePrefix:
+		if blocklistDigits(rule.Number) == "" {
+			return fmt.Errorf("%s rule needs a number", rule.Type)
+		}
+	case BlockRuleAnonymous:
+	default:
+		return fmt.Errorf("invalid block rule type %s", rule.Type)
+	}
+	if rule.Action != BlockActionBlock && rule.Action != BlockActionAllow {
+		return fmt.Errorf("invalid block rule action %s", rule.Action)
+	}
+	if rule.StartsAt != nil && rule.ExpiresAt != nil && !rule.ExpiresAt.After(*rule.StartsAt) {
+		return fmt.Errorf("block rule expires before it starts")
+	}
+	return nil
+}
+
+func blocklistDigits(number string) string {
+	var b strings.Builder
+	for _, c := range number {
+		if c >= '0' && c <= '9' {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// IsAnonymousCallerId tells whether a caller id is withheld, it accepts bare numbers and SIP URIs
+func IsAnonymousCallerId(from string) bool {
+	user := strings.ToLower(strings.TrimSpace(from))
+	user = strings.TrimPrefix(user, "sip:")
+	user = strings.TrimPrefix(user, "sips:")
+	if idx := strings.Index(user, "@"); idx != -1 {
+		user = user[:idx]
+	}
+	return anonymousCallerIds[user]
+}
+
+// normalizeBlocklistNumber returns the E.164 digits of number, or the digits it
+// contains when it can't be parsed
+func normalizeBlocklistNumber(number string, region string) string {
+	num, err := NormalizeNumber(number, region)
+	if err == nil {
+		return blocklistDigits(num.E164)
+	}
+	return blocklistDigits(ExtractNumber(number))
+}
+
+type blockTrieNode struct {
+	children map[byte]*blockTrieNode
+	rules    []*BlockRule
+}
+
+// BlockMatcher answers blocklist lookups from memory. exact numbers are a map lookup,
+// prefixes a walk down a digit trie.
+type BlockMatcher struct {
+	// Region is used to parse numbers without a country code
+	Region    string
+	exact     map[string][]*BlockRule
+	prefixes  *blockTrieNode
+	anonymous []*BlockRule
+}
+
+func NewBlockMatcher(rules []*BlockRule, region string) *BlockMatcher {
+	m := &BlockMatcher{Region: region, exact: make(map[string][]*BlockRule), prefixes: &blockTrieNode{}}
+	for _, rule := range rules {
+		m.Add(rule)
+	}
+	return m
+}
+
+func (m *BlockMatcher) Add(rule *BlockRule) {
+	switch rule.Type {
+	case BlockRuleExact:
+		key := normalizeBlocklistNumber(rule.Number, m.Region)
+		m.exact[key] = append(m.exact[key], rule)
+	case BlockRulePrefix:
+		node := m.prefixes
+		for _, c := range []byte(blocklistDigits(rule.Number)) {
+			if node.children == nil {
+				node.children = make(map[byte]*blockTrieNode)
+			}
+			next, ok := node.children[c]
+			if !ok {
+				next = &blockTrieNode{}
+				node.children[c] = next
+			}
+			node = next
+		}
+		node.rules = append(node.rules, rule)
+	case BlockRuleAnonymous:
+		m.anonymous = append(m.anonymous, rule)
+	}
+}
+
+func (m *BlockMatcher) candidates(from string) []*BlockRule {
+	if IsAnonymousCallerId(from) {
+		return m.anonymous
+	}
+	digits := normalizeBlocklistNumber(from, m.Region)
+	if digits == "" {
+		return nil
+	}
+	// most specific first: exact, then longest prefix
+	rules := append([]*BlockRule{}, m.exact[digits]...)
+	nodes := make([]*blockTrieNode, 0)
+	node := m.prefixes
+	for i := 0; i < len(digits) && node.children != nil; i++ {
+		next, ok := node.children[digits[i]]
+		if !ok {
+			break
+		}
+		nodes = append(nodes, next)
+		node = next
+	}
+	for i := len(nodes) - 1; i >= 0; i-- {
+		rules = append(rules, nodes[i].rules...)
+	}
+	return rules
+}
+
+// Match returns the rule deciding the caller and whether the call is blocked. an active
+// allow rule overrides any block rule, otherwise the most specific block rule is returned.
+func (m *BlockMatcher) Match(from string, now time.Time) (*BlockRule, bool) {
+	var block *BlockRule
+	for _, rule := range m.candidates(from) {
+		if !rule.IsActive(now) {
+			continue
+		}
+		if rule.Action == BlockActionAllow {
+			return rule, false
+		}
+		if block == nil {
+			block = rule
+		}
+	}
+	return block, block != nil
+}
+
+type cachedBlockMatcher struct {
+	matcher  *BlockMatcher
+	loadedAt time.Time
+}
+
+var blockMatcherCache = struct {
+	sync.RWMutex
+	matchers map[int]*cachedBlockMatcher
+}{matchers: make(map[int]*cachedBlockMatcher)}
+
+func getBlocklistTTL() time.Duration {
+	if val := os.Getenv("BLOCKLIST_TTL_SECONDS"); val != "" {
+		seconds, err := strconv.Atoi(val)
+		if err == nil {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return defaultBlocklistTTL
+}
+
+func GetBlockMatcher(workspaceId int) (*BlockMatcher, error) {
+	blockMatcherCache.RLock()
+	cached, ok := blockMatcherCache.matchers[workspaceId]
+	blockMatcherCache.RUnlock()
+	if ok && time.Since(cached.loadedAt) < getBlocklistTTL() {
+		return cached.matcher, nil
+	}
+	rules, err := GetBlockRules(workspaceId)
+	if err != nil {
+		return nil, err
+	}
+	matcher := NewBlockMatcher(rules, GetWorkspacePhoneRegionById(workspaceId))
+	blockMatcherCache.Lock()
+	blockMatcherCache.matchers[workspaceId] = &cachedBlockMatcher{matcher: matcher, loadedAt: time.Now()}
+	blockMatcherCache.Unlock()
+	return matcher, nil
+}
+
+func dropBlockMatcher(workspaceId int) {
+	blockMatcherCache.Lock()
+	delete(blockMatcherCache.matchers, workspaceId)
+	blockMatcherCache.Unlock()
+}
+
+// InvalidateBlocklist drops the cached matcher here and in processes running StartBlocklistSync
+func InvalidateBlocklist(workspaceId int) error {
+	dropBlockMatcher(workspaceId)
+	rdb, err := CreateRedisConn()
+	if err != nil {
+		return err
+	}
+	return rdb.Publish(blocklistChannel, strconv.Itoa(workspaceId)).Err()
+}
+
+func StartBlocklistSync() error {
+	rdb, err := CreateRedisConn()
+	if err != nil {
+		return err
+	}
+	pubsub := rdb.Subscribe(blocklistChannel)
+	_, err = pubsub.Receive()
+	if err != nil {
+		return err
+	}
+	go func() {
+		for msg := range pubsub.Channel() {
+			workspaceId, err := strconv.Atoi(msg.Payload)
+			if err != nil {
+				continue
+			}
+			dropBlockMatcher(workspaceId)
+		}
+	}()
+	return nil
+}
+
+// MatchBlocklist checks a caller against the workspace's blocklist
+func MatchBlocklist(workspaceId int, from string, now time.Time) (*BlockRule, bool, error) {
+	matcher, err := GetBlockMatcher(workspaceId)
+	if err != nil {
+		return nil, false, err
+	}
+	rule, blocked := matcher.Match(from, now)
+	return rule, blocked, nil
+}
+
+func scanBlockRule(row interface{ Scan(...interface{}) error }) (*BlockRule, error) {
+	value := BlockRule{}
+	var ruleType sql.NullString
+	var action sql.NullString
+	var note sql.NullString
+	var startsAt sql.NullTime
+	var expiresAt sql.NullTime
+	err := row.Scan(&value.Id, &value.WorkspaceId, &value.Number, &ruleType, &action, &note, &startsAt, &expiresAt, &value.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	// rows from before rule types existed are exact blocks
+	value.Type = BlockRuleExact
+	if ruleType.Valid && ruleType.String != "" {
+		value.Type = ruleType.String
+	}
+	value.Action = BlockActionBlock
+	if action.Valid && action.String != "" {
+		value.Action = action.String
+	}
+	value.Note = note.String
+	if startsAt.Valid {
+		value.StartsAt = &startsAt.Time
+	}
+	if expiresAt.Valid {
+		value.ExpiresAt = &expiresAt.Time
+	}
+	return &value, nil
+}
+
+const blockRuleColumns = "id, workspace_id, number, rule_type, action, note, starts_at, expires_at, created_at"
+
+func GetBlockRules(workspaceId int) ([]*BlockRule, error) {
+	results, err := db.Query("SELECT "+blockRuleColumns+" FROM blocked_numbers WHERE workspace_id = ?", workspaceId)
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	rules := make([]*BlockRule, 0)
+	for results.Next() {
+		rule, err := scanBlockRule(results)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, results.Err()
+}
+
+func GetBlockRule(workspaceId int, id int) (*BlockRule, error) {
+	row := db.QueryRow("SELECT "+blockRuleColumns+" FROM blocked_numbers WHERE workspace_id = ? AND id = ?", workspaceId, id)
+	return scanBlockRule(row)
+}
+
+// prepareBlockRule fills in defaults, validates and normalizes the number. region
+// is the workspace's phone region used for exact numbers.
+func prepareBlockRule(rule *BlockRule, region string) error {
+	if rule.Type == "" {
+		rule.Type = BlockRuleExact
+	}
+	if rule.Action == "" {
+		rule.Action = BlockActionBlock
+	}
+	err := rule.validate()
+	if err != nil {
+		return err
+	}
+	switch rule.Type {
+	case BlockRuleExact:
+		rule.Number = "+" + normalizeBlocklistNumber(rule.Number, region)
+	case BlockRulePrefix:
+		rule.Number = "+" + blocklistDigits(rule.Number)
+	case BlockRuleAnonymous:
+		rule.Number = ""
+	}
+	return nil
+}
+
+// blockRuleExecer is satisfied by both *sql.DB and *sql.Tx
+type blockRuleExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func insertBlockRule(exec blockRuleExecer, rule *BlockRule) error {
+	rule.CreatedAt = time.Now()
+	res, err := exec.Exec("INSERT INTO blocked_numbers (`workspace_id`, `number`, `rule_type`, `action`, `note`, `starts_at`, `expires_at`, `created_at`, `updated_at`) VALUES ( ?, ?, ?, ?, ?, ?, ?, ?, ? )",
+		rule.WorkspaceId, rule.Number, rule.Type, rule.Action, rule.Note, rule.StartsAt, rule.ExpiresAt, rule.CreatedAt, rule.CreatedAt)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	rule.Id = int(id)
+	return nil
+}
+
+func CreateBlockRule(rule *BlockRule) (*BlockRule, error) {
+	err := prepareBlockRule(rule, GetWorkspacePhoneRegionById(rule.WorkspaceId))
+	if err != nil {
+		return nil, err
+	}
+	err = insertBlockRule(db, rule)
+	if err != nil {
+		return nil, err
+	}
+	err = InvalidateBlocklist(rule.WorkspaceId)
+	if err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+func UpdateBlockRule(rule *BlockRule) error {
+	err := prepareBlockRule(rule, GetWorkspacePhoneRegionById(rule.WorkspaceId))
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE blocked_numbers SET number = ?, rule_type = ?, action = ?, note = ?, starts_at = ?, expires_at = ?, updated_at = ? WHERE workspace_id = ? AND id = ?",
+		rule.Number, rule.Type, rule.Action, rule.Note, rule.StartsAt, rule.ExpiresAt, time.Now(), rule.WorkspaceId, rule.Id)
+	if err != nil {
+		return err
+	}
+	return InvalidateBlocklist(rule.WorkspaceId)
+}
+
+func DeleteBlockRule(workspaceId int, id int) error {
+	_, err := db.Exec("DELETE FROM blocked_numbers WHERE workspace_id = ? AND id = ?", workspaceId, id)
+	if err != nil {
+		return err
+	}
+	return InvalidateBlocklist(workspaceId)
+}
+
+type BlockImportResult struct {
+	Imported int      `json:"imported"`
+	Errors   []string `json:"errors"`
+}
+
+// ImportBlockRulesCSV adds rules from CSV rows of number,type,action,expires_at,note.
+// only number is required, expires_at is RFC3339 and a header row is skipped.
+// invalid rows are reported and skipped, the valid ones are saved in one transaction.
+func ImportBlockRulesCSV(workspaceId int, r io.Reader) (*BlockImportResult, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	result := &BlockImportResult{Errors: make([]string, 0)}
+	region := GetWorkspacePhoneRegionById(workspaceId)
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	line := 0
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		line++
+		if err != nil {
+			tx.Rollback()
+			result.Imported = 0
+			return result, err
+		}
+		if line == 1 && len(record) > 0 && strings.EqualFold(strings.TrimSpace(record[0]), "number") {
+			continue
+		}
+		field := func(i int) string {
+			if i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		rule := &BlockRule{WorkspaceId: workspaceId, Number: field(0), Type: field(1), Action: field(2), Note: field(4)}
+		if expires := field(3); expires != "" {
+			t, err := time.Parse(time.RFC3339, expires)
+			if err != nil {
+				result.Errors = append(result.Errors, fmt.Sprintf("line %d: invalid expires_at %s", line, expires))
+				continue
+			}
+			rule.ExpiresAt = &t
+		}
+		err = prepareBlockRule(rule, region)
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("line %d: %v", line, err))
+			continue
+		}
+		err = insertBlockRule(tx, rule)
+		if err != nil {
+			tx.Rollback()
+			result.Imported = 0
+			return result, fmt.Errorf("line %d: %v", line, err)
+		}
+		result.Imported++
+	}
+	err = tx.Commit()
+	if err != nil {
+		result.Imported = 0
+		return result, err
+	}
+	if result.Imported == 0 {
+		return result, nil
+	}
+	return result, InvalidateBlocklist(workspaceId)
+}
@@ -0,0 +1,325 @@
+package helpers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	CallerIdSourceDID      = "did"
+	CallerIdSourceBYODID   = "byo_did"
+	CallerIdSourceVerified = "verified"
+	CallerIdSourceNone     = "none"
+)
+
+const (
+	VerificationMethodCall = "call"
+	VerificationMethodSMS  = "sms"
+)
+
+const (
+	CallerIdPending  = "pending"
+	CallerIdVerified = "verified"
+)
+
+const (
+	verificationCodeDigits   = 6
+	verificationCodeTTL      = 10 * time.Minute
+	maxVerificationAttempts  = 5
+	maxVerificationsPerHour  = 5
+	defaultCallerIdValidDays = 365
+)
+
+var (
+	ErrVerificationExpired     = errors.New("verification code expired")
+	ErrVerificationInvalidCode = errors.New("invalid verification code")
+	ErrVerificationTooMany     = errors.New("too many verification attempts")
+	ErrVerificationNotPending  = errors.New("no pending verification for number")
+	ErrNoCodeSender            = errors.New("no verification code sender configured")
+)
+
+// VerificationCodeSender delivers one time codes by outbound call or SMS
+type VerificationCodeSender interface {
+	SendCode(workspaceId int, number string, code string, method string) error
+}
+
+var verificationCodeSender VerificationCodeSender
+
+func SetVerificationCodeSender(sender VerificationCodeSender) {
+	verificationCodeSender = sender
+}
+
+type VerifiedCallerId struct {
+	Id          int        `json:"id"`
+	WorkspaceId int        `json:"workspace_id"`
+	Number      string     `json:"number"`
+	Status      string     `json:"status"`
+	Method      string     `json:"method"`
+	VerifiedAt  *time.Time `json:"verified_at"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// CallerIdVerification tells whether a workspace may use a number as caller id and why
+type CallerIdVerification struct {
+	Number   string `json:"number"`
+	Verified bool   `json:"verified"`
+	Source   string `json:"source"`
+}
+
+func getCallerIdValidity() time.Duration {
+	days := defaultCallerIdValidDays
+	if val := os.Getenv("CALLER_ID_VALIDITY_DAYS"); val != "" {
+		parsed, err := strconv.Atoi(val)
+		if err == nil {
+			days = parsed
+		}
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+func generateVerificationCode() (string, error) {
+	max := big.NewInt(1)
+	for i := 0; i < verificationCodeDigits; i++ {
+		max.Mul(max, big.NewInt(10))
+	}
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", verificationCodeDigits, n.Int64()), nil
+}
+
+func hashVerificationCode(workspaceId int, number string, code string) string {
+	sum := sha256.Sum256([]byte(strconv.Itoa(workspaceId) + ":" + number + ":" + code))
+	return hex.EncodeToString(sum[:])
+}
+
+func checkVerificationRate(workspaceId int) error {
+	rdb, err := CreateRedisConn()
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("caller_id_verifications:%d:%s", workspaceId, time.Now().Format("2006010215"))
+	count, err := rdb.Incr(key).Result()
+	if err != nil {
+		return err
+	}
+	rdb.Expire(key, time.Hour)
+	if count > maxVerificationsPerHour {
+		return ErrVerificationTooMany
+	}
+	return nil
+}
+
+func scanVerifiedCallerId(row interface{ Scan(...interface{}) error }) (*VerifiedCallerId, error) {
+	value := VerifiedCallerId{}
+	var verifiedAt sql.NullTime
+	var expiresAt sql.NullTime
+	err := row.Scan(&value.Id, &value.WorkspaceId, &value.Number, &value.Status, &value.Method, &verifiedAt, &expiresAt, &value.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if verifiedAt.Valid {
+		value.VerifiedAt = &verifiedAt.Time
+	}
+	if expiresAt.Valid {
+		value.ExpiresAt = &expiresAt.Time
+	}
+	return &value, nil
+}
+
+const verifiedCallerIdColumns = "id, workspace_id, number, status, method, verified_at, expires_at, created_at"
+
+// StartCallerIdVerification registers number for the workspace and sends it a one
+// time code. starting again replaces any earlier code.
+func StartCallerIdVerification(workspaceId int, number string, method string) (*VerifiedCallerId, error) {
+	if method != VerificationMethodCall && method != VerificationMethodSMS {
+		return nil, fmt.Errorf("invalid verification method %s", method)
+	}
+	if verificationCodeSender == nil {
+		return nil, ErrNoCodeSender
+	}
+	num, err := NormalizeNumber(number, GetWorkspacePhoneRegionById(workspaceId))
+	if err != nil {
+		return nil, err
+	}
+	if !num.Valid {
+		return nil, ErrInvalidPhoneNumber
+	}
+	err = checkVerificationRate(workspaceId)
+	if err != nil {
+		return nil, err
+	}
+	code, err := generateVerificationCode()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	codeHash := hashVerificationCode(workspaceId, num.E164, code)
+	// verified_caller_ids has a unique key on (workspace_id, number, status) so concurrent
+	// starts share one pending row, a verified number stays usable until it is confirmed
+	_, err = db.Exec(`INSERT INTO verified_caller_ids (`+"`workspace_id`, `number`, `status`, `method`, `code_hash`, `code_expires_at`, `attempts`, `created_at`, `updated_at`"+`) VALUES ( ?, ?, ?, ?, ?, ?, 0, ?, ? )
+		ON DUPLICATE KEY UPDATE method = VALUES(method), code_hash = VALUES(code_hash), code_expires_at = VALUES(code_expires_at), attempts = 0, updated_at = VALUES(updated_at)`,
+		workspaceId, num.E164, CallerIdPending, method, codeHash, now.Add(verificationCodeTTL), now, now)
+	if err != nil {
+		return nil, err
+	}
+
+	err = verificationCodeSender.SendCode(workspaceId, num.E164, code, method)
+	if err != nil {
+		return nil, err
+	}
+	row := db.QueryRow("SELECT "+verifiedCallerIdColumns+" FROM verified_caller_ids WHERE workspace_id = ? AND number = ? AND status = ?", workspaceId, num.E164, CallerIdPending)
+	return scanVerifiedCallerId(row)
+}
+
+// ConfirmCallerIdVerification checks the code sent by StartCallerIdVerification and
+// marks the number verified
+func ConfirmCallerIdVerification(workspaceId int, number string, code string) (*VerifiedCallerId, error) {
+	num, err := NormalizeNumber(number, GetWorkspacePhoneRegionById(workspaceId))
+	if err != nil {
+		return nil, err
+	}
+	var id int
+	var codeHash string
+	var codeExpiresAt time.Time
+	row := db.QueryRow("SELECT id, code_hash, code_expires_at FROM verified_caller_ids WHERE workspace_id = ? AND number = ? AND status = ?", workspaceId, num.E164, CallerIdPending)
+	err = row.Scan(&id, &codeHash, &codeExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrVerificationNotPending
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if !now.Before(codeExpiresAt) {
+		_, err = db.Exec("DELETE FROM verified_caller_ids WHERE id = ? AND status = ?", id, CallerIdPending)
+		if err != nil {
+			return nil, err
+		}
+		return nil, ErrVerificationExpired
+	}
+	// use up an attempt before comparing so concurrent guesses can't go over the limit
+	res, err := db.Exec("UPDATE verified_caller_ids SET attempts = attempts + 1, updated_at = ? WHERE id = ? AND attempts < ?", now, id, maxVerificationAttempts)
+	if err != nil {
+		return nil, err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, ErrVerificationTooMany
+	}
+	given := hashVerificationCode(workspaceId, num.E164, code)
+	if subtle.ConstantTimeCompare([]byte(given), []byte(codeHash)) != 1 {
+		return nil, ErrVerificationInvalidCode
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec("DELETE FROM verified_caller_ids WHERE workspace_id = ? AND number = ? AND status = ?", workspaceId, num.E164, CallerIdVerified)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	_, err = tx.Exec("UPDATE verified_caller_ids SET status = ?, code_hash = NULL, verified_at = ?, expires_at = ?, updated_at = ? WHERE id = ?",
+		CallerIdVerified, now, now.Add(getCallerIdValidity()), now, id)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	row = db.QueryRow("SELECT "+verifiedCallerIdColumns+" FROM verified_caller_ids WHERE id = ?", id)
+	return scanVerifiedCallerId(row)
+}
+
+// CleanupExpiredCallerIdVerifications deletes pending verifications whose code
+// expired before now, run it periodically
+func CleanupExpiredCallerIdVerifications(now time.Time) error {
+	_, err := db.Exec("DELETE FROM verified_caller_ids WHERE status = ? AND code_expires_at < ?", CallerIdPending, now)
+	return err
+}
+
+func GetVerifiedCallerIds(workspaceId int) ([]*VerifiedCallerId, error) {
+	results, err := db.Query("SELECT "+verifiedCallerIdColumns+" FROM verified_caller_ids WHERE workspace_id = ?", workspaceId)
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	values := make([]*VerifiedCallerId, 0)
+	for results.Next() {
+		value, err := scanVerifiedCallerId(results)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, results.Err()
+}
+
+func DeleteVerifiedCallerId(workspaceId int, id int) error {
+	_, err := db.Exec("DELETE FROM verified_caller_ids WHERE workspace_id = ? AND id = ?", workspaceId, id)
+	return err
+}
+
+func rowExists(query string, args ...interface{}) (bool, error) {
+	var id int
+	err := db.QueryRow(query, args...).Scan(&id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// VerifyCallerId checks the workspace owns number as a DID, a BYO DID or a verified caller id
+func VerifyCallerId(workspace *Workspace, number string) (*CallerIdVerification, error) {
+	num, err := NormalizeWorkspaceNumber(workspace, number)
+	if err != nil {
+		return nil, err
+	}
+	result := &CallerIdVerification{Number: num.E164, Source: CallerIdSourceNone}
+	checks := []struct {
+		source string
+		query  string
+		args   []interface{}
+	}{
+		{CallerIdSourceDID, "SELECT id FROM `did_numbers` WHERE `number` = ? AND `workspace_id` = ?", []interface{}{num.E164, workspace.Id}},
+		{CallerIdSourceBYODID, "SELECT id FROM `byo_did_numbers` WHERE `number` = ? AND `workspace_id` = ?", []interface{}{num.E164, workspace.Id}},
+		{CallerIdSourceVerified, "SELECT id FROM `verified_caller_ids` WHERE `number` = ? AND `workspace_id` = ? AND `status` = ? AND (`expires_at` IS NULL OR `expires_at` > ?)",
+			[]interface{}{num.E164, workspace.Id, CallerIdVerified, time.Now()}},
+	}
+	for _, check := range checks {
+		found, err := rowExists(check.query, check.args...)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			result.Verified = true
+			result.Source = check.source
+			return result, nil
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,168 @@
+package helpers
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	NodeActionDrain       = "drain"
+	NodeActionMaintenance = "maintenance"
+	NodeActionRestore     = "restore"
+)
+
+const defaultDrainPollInterval = 5 * time.Second
+
+type NodeAuditRecord struct {
+	Id            int       `json:"id"`
+	MediaServerId int       `json:"media_server_id"`
+	Action        string    `json:"action"`
+	Actor         string    `json:"actor"`
+	Reason        string    `json:"reason"`
+	CallCount     int       `json:"call_count"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+type DrainResult struct {
+	MediaServerId int `json:"media_server_id"`
+	// Forced is true when the deadline passed with calls still up
+	Forced bool `json:"forced"`
+	// Aborted is true when the server stopped draining during the wait, e.g. it was restored
+	Aborted        bool          `json:"aborted"`
+	RemainingCalls int           `json:"remaining_calls"`
+	Waited         time.Duration `json:"waited"`
+}
+
+func createNodeAudit(serverId int, action string, actor string, reason string, callCount int) error {
+	_, err := db.Exec("INSERT INTO media_servers_audit (`media_server_id`, `action`, `actor`, `reason`, `call_count`, `created_at`) VALUES ( ?, ?, ?, ?, ?, ? )",
+		serverId, action, actor, reason, callCount, time.Now())
+	return err
+}
+
+func setMediaServerStatus(server *MediaServer, status string, action string, actor string, reason string) error {
+	err := UpdateLiveStat(server, LiveStatStatus, status)
+	if err != nil {
+		return err
+	}
+	server.Status = status
+	return createNodeAudit(server.Id, action, actor, reason, server.LiveCallCount)
+}
+
+// getLiveCallCount prefers the real time count from Redis over the flushed one
+func getLiveCallCount(server *MediaServer) int {
+	stats, err := GetLiveStats(MemberKindMediaServer, server.Id)
+	if err == nil && stats.LiveCallCount != nil {
+		return *stats.LiveCallCount
+	}
+	fresh, err := GetMediaServer(server.Id)
+	if err != nil {
+		fmt.Printf("could not refresh media server %d: %v\r\n", server.Id, err)
+		return server.LiveCallCount
+	}
+	return fresh.LiveCallCount
+}
+
+// DrainMediaServer stops new calls going to the server, calls already on it continue
+func DrainMediaServer(serverId int, actor string, reason string) (*MediaServer, error) {
+	server, err := GetMediaServer(serverId)
+	if err != nil {
+		return nil, err
+	}
+	if server.Status == NodeStatusDraining || server.Status == NodeStatusMaintenance {
+		return server, nil
+	}
+	err = setMediaServerStatus(server, NodeStatusDraining, NodeActionDrain, actor, reason)
+	if err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+// WaitForDrain polls the server until its calls reach zero or the deadline passes,
+// then puts it in maintenance. it gives up without touching the server when the
+// server stops draining, e.g. an operator restored it meanwhile.
+func WaitForDrain(server *MediaServer, deadline time.Time, actor string, pollInterval time.Duration) (*DrainResult, error) {
+	if pollInterval <= 0 {
+		pollInterval = defaultDrainPollInterval
+	}
+	started := time.Now()
+	result := &DrainResult{MediaServerId: server.Id}
+	for {
+		current, err := GetMediaServer(server.Id)
+		if err != nil {
+			return nil, err
+		}
+		if current.Status != NodeStatusDraining {
+			result.Aborted = true
+			result.Waited = time.Since(started)
+			server.Status = current.Status
+			return result, nil
+		}
+		result.RemainingCalls = getLiveCallCount(server)
+		if result.RemainingCalls == 0 {
+			break
+		}
+		if !time.Now().Before(deadline) {
+			result.Forced = true
+			break
+		}
+		wait := time.Until(deadline)
+		if wait > pollInterval {
+			wait = pollInterval
+		}
+		time.Sleep(wait)
+	}
+	result.Waited = time.Since(started)
+
+	reason := "drained"
+	if result.Forced {
+		reason = fmt.Sprintf("drain deadline passed with %d call(s) up", result.RemainingCalls)
+	}
+	server.LiveCallCount = result.RemainingCalls
+	err := setMediaServerStatus(server, NodeStatusMaintenance, NodeActionMaintenance, actor, reason)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// DrainAndWait drains the server and blocks until it is in maintenance
+func DrainAndWait(serverId int, actor string, reason string, timeout time.Duration) (*DrainResult, error) {
+	server, err := DrainMediaServer(serverId, actor, reason)
+	if err != nil {
+		return nil, err
+	}
+	return WaitForDrain(server, time.Now().Add(timeout), actor, defaultDrainPollInterval)
+}
+
+// RestoreMediaServer puts a drained or maintenance server back in rotation
+func RestoreMediaServer(serverId int, actor string, reason string) (*MediaServer, error) {
+	server, err := GetMediaServer(serverId)
+	if err != nil {
+		return nil, err
+	}
+	err = setMediaServerStatus(server, NodeStatusOnline, NodeActionRestore, actor, reason)
+	if err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+func GetMediaServerAudit(serverId int) ([]*NodeAuditRecord, error) {
+	results, err := db.Query("SELECT id, media_server_id, action, actor, reason, call_count, created_at FROM media_servers_audit WHERE media_server_id = ? ORDER BY created_at DESC", serverId)
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	records := make([]*NodeAuditRecord, 0)
+	for results.Next() {
+		value := NodeAuditRecord{}
+		err = results.Scan(&value.Id, &value.MediaServerId, &value.Action, &value.Actor, &value.Reason, &value.CallCount, &value.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, &value)
+	}
+	return records, results.Err()
+}
@@ -0,0 +1,248 @@
+package helpers
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type SuspensionState string
+
+const (
+	SuspensionStateActive    SuspensionState = "active"
+	SuspensionStateGrace     SuspensionState = "grace"
+	SuspensionStateSuspended SuspensionState = "suspended"
+)
+
+const (
+	SuspensionReasonPaymentFailed = "payment_failed"
+	SuspensionReasonDispute       = "dispute"
+)
+
+type DunningConfig struct {
+	GracePeriod time.Duration
+	// ReminderIntervals are measured from when the suspension was created
+	ReminderIntervals []time.Duration
+}
+
+type SuspensionStatus struct {
+	State       SuspensionState `json:"state"`
+	Reason      string          `json:"reason"`
+	SuspendedAt *time.Time      `json:"suspended_at"`
+	Deadline    *time.Time      `json:"deadline"`
+}
+
+type workspaceSuspension struct {
+	Id                   int
+	WorkspaceId          int
+	Reason               string
+	SuspendedAt          time.Time
+	GracePeriodExtension int
+	RemindersSent        int
+}
+
+func parseDaysList(val string) []time.Duration {
+	durations := make([]time.Duration, 0)
+	for _, part := range strings.Split(val, ",") {
+		days, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		durations = append(durations, time.Duration(days)*24*time.Hour)
+	}
+	// reminders are sent in order, so the list may be given in any order
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	return durations
+}
+
+// GetDunningConfig reads DUNNING_GRACE_DAYS and DUNNING_REMINDER_DAYS, defaulting to
+// a 7 day grace period with reminders on days 0, 3 and 6
+func GetDunningConfig() *DunningConfig {
+	config := &DunningConfig{
+		GracePeriod:       7 * 24 * time.Hour,
+		ReminderIntervals: []time.Duration{0, 3 * 24 * time.Hour, 6 * 24 * time.Hour},
+	}
+	if val := os.Getenv("DUNNING_GRACE_DAYS"); val != "" {
+		days, err := strconv.Atoi(val)
+		if err == nil {
+			config.GracePeriod = time.Duration(days) * 24 * time.Hour
+		}
+	}
+	if val := os.Getenv("DUNNING_REMINDER_DAYS"); val != "" {
+		config.ReminderIntervals = parseDaysList(val)
+	}
+	return config
+}
+
+func getOpenSuspensions(workspaceId int) ([]workspaceSuspension, error) {
+	query := "SELECT id, workspace_id, reason, suspended_at, grace_period_extension, reminders_sent FROM workspaces_suspensions WHERE lifted_at IS NULL"
+	args := []interface{}{}
+	if workspaceId != 0 {
+		query = query + " AND workspace_id = ?"
+		args = append(args, workspaceId)
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	suspensions := make([]workspaceSuspension, 0)
+	for rows.Next() {
+		value := workspaceSuspension{}
+		var reason sql.NullString
+		var extension sql.NullInt64
+		var remindersSent sql.NullInt64
+		err = rows.Scan(&value.Id, &value.WorkspaceId, &reason, &value.SuspendedAt, &extension, &remindersSent)
+		if err != nil {
+			return nil, err
+		}
+		value.Reason = reason.String
+		value.GracePeriodExtension = int(extension.Int64)
+		value.RemindersSent = int(remindersSent.Int64)
+		suspensions = append(suspensions, value)
+	}
+	return suspensions, rows.Err()
+}
+
+func suspensionDeadline(suspension *workspaceSuspension, config *DunningConfig) time.Time {
+	// grace_period_extension is stored in hours
+	return suspension.SuspendedAt.Add(config.GracePeriod + time.Duration(suspension.GracePeriodExtension)*time.Hour)
+}
+
+// GetSuspensionStatus reports whether the workspace is in good standing, inside the
+// grace period of an open suspension, or suspended
+func GetSuspensionStatus(workspaceId int, now time.Time) (*SuspensionStatus, error) {
+	suspensions, err := getOpenSuspensions(workspaceId)
+	if err != nil {
+		return nil, err
+	}
+	if len(suspensions) == 0 {
+		return &SuspensionStatus{State: SuspensionStateActive}, nil
+	}
+
+	config := GetDunningConfig()
+	var status *SuspensionStatus
+	for i := range suspensions {
+		suspension := &suspensions[i]
+		deadline := suspensionDeadline(suspension, config)
+		current := &SuspensionStatus{State: SuspensionStateGrace, Reason: suspension.Reason, SuspendedAt: &suspension.SuspendedAt, Deadline: &deadline}
+		if !now.Before(deadline) {
+			current.State = SuspensionStateSuspended
+		}
+		// report the most severe, earliest deadline first
+		if status == nil || (current.State == SuspensionStateSuspended && status.State != SuspensionStateSuspended) ||
+			(current.State == status.State && current.Deadline.Before(*status.Deadline)) {
+			status = current
+		}
+	}
+	return status, nil
+}
+
+// CanPlaceOutboundCall is used by call setup to block outbound calls from suspended workspaces
+func CanPlaceOutboundCall(workspaceId int) (bool, *SuspensionStatus, error) {
+	status, err := GetSuspensionStatus(workspaceId, time.Now())
+	if err != nil {
+		return false, nil, err
+	}
+	return status.State != SuspensionStateSuspended, status, nil
+}
+
+// CreateWorkspaceSuspension opens a suspension unless one with the same reason is already open
+func CreateWorkspaceSuspension(workspaceId int, reason string, now time.Time) error {
+	var id int
+	row := db.QueryRow("SELECT id FROM workspaces_suspensions WHERE workspace_id = ? AND reason = ? AND lifted_at IS NULL", workspaceId, reason)
+	err := row.Scan(&id)
+	if err == nil {
+		return nil
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+	_, err = db.Exec("INSERT INTO workspaces_suspensions (`workspace_id`, `reason`, `suspended_at`, `reminders_sent`, `created_at`, `updated_at`) VALUES ( ?, ?, ?, 0, ?, ? )",
+		workspaceId, reason, now, now, now)
+	return err
+}
+
+func LiftWorkspaceSuspensions(workspaceId int, reason string) error {
+	now := time.Now()
+	_, err := db.Exec("UPDATE workspaces_suspensions SET lifted_at = ?, updated_at = ? WHERE workspace_id = ? AND reason = ? AND lifted_at IS NULL", now, now, workspaceId, reason)
+	return err
+}
+
+// ExtendGracePeriod pushes back the deadline of the workspace's open suspensions
+func ExtendGracePeriod(workspaceId int, extension time.Duration) error {
+	hours := int(extension / time.Hour)
+	_, err := db.Exec("UPDATE workspaces_suspensions SET grace_period_extension = COALESCE(grace_period_extension, 0) + ?, updated_at = ? WHERE workspace_id = ? AND lifted_at IS NULL",
+		hours, time.Now(), workspaceId)
+	return err
+}
+
+// OnPaymentFailed starts dunning for the workspace, the first reminder goes out on the next ProcessDunning run
+func OnPaymentFailed(workspaceId int, now time.Time) error {
+	return CreateWorkspaceSuspension(workspaceId, SuspensionReasonPaymentFailed, now)
+}
+
+// OnPaymentSucceeded lifts payment related suspensions. disputes stay open until resolved by hand.
+func OnPaymentSucceeded(workspaceId int) error {
+	return LiftWorkspaceSuspensions(workspaceId, SuspensionReasonPaymentFailed)
+}
+
+// ProcessDunning sends due reminder emails for open suspensions, run it periodically
+func ProcessDunning(now time.Time) error {
+	suspensions, err := getOpenSuspensions(0)
+	if err != nil {
+		return err
+	}
+	config := GetDunningConfig()
+	for i := range suspensions {
+		suspension := &suspensions[i]
+		if suspension.RemindersSent >= len(config.ReminderIntervals) {
+			continue
+		}
+		if now.Before(suspension.SuspendedAt.Add(config.ReminderIntervals[suspension.RemindersSent])) {
+			continue
+		}
+		err = sendDunningReminder(suspension, suspensionDeadline(suspension, config), now)
+		if err != nil {
+			fmt.Printf("could not send dunning reminder for workspace %d: %v\r\n", suspension.WorkspaceId, err)
+			continue
+		}
+		_, err = db.Exec("UPDATE workspaces_suspensions SET reminders_sent = reminders_sent + 1, last_reminder_at = ?, updated_at = ? WHERE id = ?", now, now, suspension.Id)
+		if err != nil {
+			fmt.Printf("could not update dunning reminder for workspace %d: %v\r\n", suspension.WorkspaceId, err)
+		}
+	}
+	return nil
+}
+
+func sendDunningReminder(suspension *workspaceSuspension, deadline time.Time, now time.Time) error {
+	user, _, err := getSubscriptionOwner(suspension.WorkspaceId)
+	if err != nil {
+		return err
+	}
+	if suspension.Reason == SuspensionReasonDispute {
+		if !now.Before(deadline) {
+			body := `Your workspace has been suspended and outbound calling is disabled because a payment was disputed. Please contact support to resolve the dispute and restore service.`
+			SendEmail(user, "Your workspace has been suspended", body)
+			return nil
+		}
+		body := fmt.Sprintf(`A payment for your workspace was disputed with your bank. Please contact support before %s to avoid suspension of outbound calling.`,
+			deadline.Format("2006 Jan 02"))
+		SendEmail(user, "Action required: payment disputed", body)
+		return nil
+	}
+	if !now.Before(deadline) {
+		body := `Your workspace has been suspended and outbound calling is disabled. Please update your payment details to restore service.`
+		SendEmail(user, "Your workspace has been suspended", body)
+		return nil
+	}
+	body := fmt.Sprintf(`We could not process your latest payment. Please update your payment details before %s to avoid suspension of outbound calling.`,
+		deadline.Format("2006 Jan 02"))
+	SendEmail(user, "Action required: payment failed", body)
+	return nil
+}
@@ -0,0 +1,164 @@
+package helpers
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type Feature string
+
+const (
+	FeatureImIntegrations           Feature = "im_integrations"
+	FeatureProductivityIntegrations Feature = "productivity_integrations"
+	FeatureVoiceAnalytics           Feature = "voice_analytics"
+	FeatureFraudProtection          Feature = "fraud_protection"
+	FeatureCrmIntegrations          Feature = "crm_integrations"
+	FeatureProgrammableToolkit      Feature = "programmable_toolkit"
+	FeatureSso                      Feature = "sso"
+	FeatureProvisioner              Feature = "provisioner"
+	FeatureVpn                      Feature = "vpn"
+	FeatureMultipleSipDomains       Feature = "multiple_sip_domains"
+	FeatureBringCarrier             Feature = "bring_carrier"
+	FeatureCallCenter               Feature = "call_center"
+	Feature247Support               Feature = "247_support"
+	FeatureAiCalls                  Feature = "ai_calls"
+)
+
+const entitlementsCacheTTL = 5 * time.Minute
+
+const ServicePlanStatusActive = "active"
+
+type PlanLimits struct {
+	Extensions          int  `json:"extensions"`
+	UnlimitedExtensions bool `json:"unlimited_extensions"`
+	Ports               int  `json:"ports"`
+	RecordingSpaceKb    int  `json:"recording_space_kb"`
+	Faxes               int  `json:"faxes"`
+	UnlimitedFax        bool `json:"unlimited_fax"`
+	MinutesPerMonth     int  `json:"minutes_per_month"`
+}
+
+type Entitlements struct {
+	PlanId   int    `json:"plan_id"`
+	PlanKey  string `json:"plan_key"`
+	PlanName string `json:"plan_name"`
+	// MonthlyCostCents and Rank order plans when suggesting upgrades
+	MonthlyCostCents int `json:"monthly_cost_cents"`
+	Rank             int `json:"rank"`
+	// Offered is true for active, public plans customers can switch to
+	Offered  bool             `json:"offered"`
+	Limits   PlanLimits       `json:"limits"`
+	Features map[Feature]bool `json:"features"`
+}
+
+var entitlementsMu sync.RWMutex
+var entitlementsByPlan map[string]*Entitlements
+var entitlementsLoadedAt time.Time
+
+func planFeatures(plan *ServicePlan) map[Feature]bool {
+	return map[Feature]bool{
+		FeatureImIntegrations:           plan.ImIntegrations,
+		FeatureProductivityIntegrations: plan.ProductivityIntegrations,
+		FeatureVoiceAnalytics:           plan.VoiceAnalytics,
+		FeatureFraudProtection:          plan.FraudProtection,
+		FeatureCrmIntegrations:          plan.CrmIntegrations,
+		FeatureProgrammableToolkit:      plan.ProgrammableToolkit,
+		FeatureSso:                      plan.Sso,
+		FeatureProvisioner:              plan.Provisioner,
+		FeatureVpn:                      plan.Vpn,
+		FeatureMultipleSipDomains:       plan.MultipleSipDomains,
+		FeatureBringCarrier:             plan.BringCarrier,
+		FeatureCallCenter:               plan.CallCenter,
+		Feature247Support:               plan.Config247Support,
+		FeatureAiCalls:                  plan.AiCalls,
+	}
+}
+
+// isOfferedPlan tells whether customers can pick plan, plans without a status are active
+func isOfferedPlan(plan *ServicePlan) bool {
+	if plan.DeletedAt != nil || !plan.IncludeInPricingPages {
+		return false
+	}
+	return plan.Status == "" || plan.Status == ServicePlanStatusActive
+}
+
+func CreateEntitlements(plan *ServicePlan) *Entitlements {
+	return &Entitlements{
+		PlanId:           plan.Id,
+		PlanKey:          plan.KeyName,
+		PlanName:         plan.NiceName,
+		MonthlyCostCents: plan.MonthlyCostCents,
+		Rank:             plan.Rank,
+		Offered:          isOfferedPlan(plan),
+		Limits: PlanLimits{
+			Extensions:          plan.Extensions,
+			UnlimitedExtensions: plan.UnlimitedExtensions,
+			Ports:               plan.Ports,
+			RecordingSpaceKb:    int(plan.RecordingSpace),
+			Faxes:               plan.Fax,
+			UnlimitedFax:        plan.UnlimitedFax,
+			MinutesPerMonth:     int(plan.MinutesPerMonth),
+		},
+		Features: planFeatures(plan),
+	}
+}
+
+// RefreshEntitlements reloads plans from service_plans, call it after plans are edited
+func RefreshEntitlements() error {
+	plans, err := GetServicePlans2()
+	if err != nil {
+		return err
+	}
+	byPlan := make(map[string]*Entitlements)
+	for i := range plans {
+		// plans come live first, so a deleted or inactive plan never shadows the live one sharing its key
+		if _, ok := byPlan[plans[i].KeyName]; ok {
+			continue
+		}
+		byPlan[plans[i].KeyName] = CreateEntitlements(&plans[i])
+	}
+
+	entitlementsMu.Lock()
+	defer entitlementsMu.Unlock()
+	entitlementsByPlan = byPlan
+	entitlementsLoadedAt = time.Now()
+	return nil
+}
+
+func RefreshEntitlementsIfStale() error {
+	entitlementsMu.RLock()
+	stale := entitlementsByPlan == nil || time.Since(entitlementsLoadedAt) > entitlementsCacheTTL
+	entitlementsMu.RUnlock()
+	if !stale {
+		return nil
+	}
+	return RefreshEntitlements()
+}
+
+func GetPlanEntitlements(planKey string) (*Entitlements, error) {
+	err := RefreshEntitlementsIfStale()
+	if err != nil {
+		return nil, err
+	}
+
+	entitlementsMu.RLock()
+	defer entitlementsMu.RUnlock()
+	entitlements, ok := entitlementsByPlan[planKey]
+	if !ok {
+		return nil, fmt.Errorf("no service plan with key %s", planKey)
+	}
+	return entitlements, nil
+}
+
+func GetEntitlements(workspace *Workspace) (*Entitlements, error) {
+	return GetPlanEntitlements(workspace.Plan)
+}
+
+func Can(workspace *Workspace, feature Feature) (bool, error) {
+	entitlements, err := GetEntitlements(workspace)
+	if err != nil {
+		return false, err
+	}
+	return entitlements.Features[feature], nil
+}
@@ -0,0 +1,327 @@
+package helpers
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const (
+	FraudAllow     = "allow"
+	FraudChallenge = "challenge"
+	FraudBlock     = "block"
+)
+
+const (
+	FraudSignalPremiumDestination = "premium_destination"
+	FraudSignalHighRiskPrefix     = "high_risk_prefix"
+	FraudSignalCallVelocity       = "call_velocity"
+	FraudSignalSpendVelocity      = "spend_velocity"
+	FraudSignalUnusualHour        = "unusual_hour"
+	FraudSignalNewCountry         = "new_country"
+)
+
+const fraudCacheTTL = 5 * time.Minute
+
+// how long a workspace's called countries are remembered
+const fraudCountriesTTL = 90 * 24 * time.Hour
+
+// FraudThresholds configure scoring for a plan. a score at or above ChallengeScore
+// asks for confirmation, at or above BlockScore the call is refused.
+type FraudThresholds struct {
+	ChallengeScore       int `json:"challenge_score"`
+	BlockScore           int `json:"block_score"`
+	MaxCallsPerMinute    int `json:"max_calls_per_minute"`
+	MaxSpendPerHourCents int `json:"max_spend_per_hour_cents"`
+	PremiumScore         int `json:"premium_score"`
+	VelocityScore        int `json:"velocity_score"`
+	UnusualHourScore     int `json:"unusual_hour_score"`
+	NewCountryScore      int `json:"new_country_score"`
+	QuietHourStart       int `json:"quiet_hour_start"`
+	QuietHourEnd         int `json:"quiet_hour_end"`
+}
+
+var DefaultFraudThresholds = FraudThresholds{
+	ChallengeScore:       50,
+	BlockScore:           100,
+	MaxCallsPerMinute:    30,
+	MaxSpendPerHourCents: 5000,
+	PremiumScore:         60,
+	VelocityScore:        50,
+	UnusualHourScore:     15,
+	NewCountryScore:      25,
+	QuietHourStart:       0,
+	QuietHourEnd:         6,
+}
+
+type FraudSignal struct {
+	Name   string `json:"name"`
+	Score  int    `json:"score"`
+	Detail string `json:"detail"`
+}
+
+type FraudDecision struct {
+	Action      string        `json:"action"`
+	Score       int           `json:"score"`
+	Enabled     bool          `json:"enabled"`
+	Signals     []FraudSignal `json:"signals"`
+	Destination *PhoneNumber  `json:"destination"`
+}
+
+func (d *FraudDecision) add(name string, score int, detail string) {
+	d.Signals = append(d.Signals, FraudSignal{Name: name, Score: score, Detail: detail})
+	d.Score += score
+}
+
+var fraudCache = struct {
+	sync.RWMutex
+	thresholds map[string]*FraudThresholds
+	prefixes   map[string]int
+	loadedAt   time.Time
+}{}
+
+func loadFraudConfig() error {
+	thresholds := make(map[string]*FraudThresholds)
+	results, err := db.Query(`SELECT plan, challenge_score, block_score, max_calls_per_minute, max_spend_per_hour_cents,
+	premium_score, velocity_score, unusual_hour_score, new_country_score, quiet_hour_start, quiet_hour_end
+	FROM fraud_thresholds`)
+	if err != nil {
+		return err
+	}
+	for results.Next() {
+		var plan string
+		value := FraudThresholds{}
+		err = results.Scan(&plan, &value.ChallengeScore, &value.BlockScore, &value.MaxCallsPerMinute, &value.MaxSpendPerHourCents,
+			&value.PremiumScore, &value.VelocityScore, &value.UnusualHourScore, &value.NewCountryScore, &value.QuietHourStart, &value.QuietHourEnd)
+		if err != nil {
+			results.Close()
+			return err
+		}
+		thresholds[plan] = &value
+	}
+	results.Close()
+
+	prefixes := make(map[string]int)
+	results, err = db.Query("SELECT prefix, score FROM fraud_risk_prefixes")
+	if err != nil {
+		return err
+	}
+	defer results.Close()
+	for results.Next() {
+		var prefix string
+		var score int
+		err = results.Scan(&prefix, &score)
+		if err != nil {
+			return err
+		}
+		prefixes[blocklistDigits(prefix)] = score
+	}
+
+	fraudCache.Lock()
+	fraudCache.thresholds = thresholds
+	fraudCache.prefixes = prefixes
+	fraudCache.loadedAt = time.Now()
+	fraudCache.Unlock()
+	return nil
+}
+
+func refreshFraudConfigIfStale() error {
+	fraudCache.RLock()
+	stale := fraudCache.thresholds == nil || time.Since(fraudCache.loadedAt) > fraudCacheTTL
+	fraudCache.RUnlock()
+	if !stale {
+		return nil
+	}
+	return loadFraudConfig()
+}
+
+// GetFraudThresholds returns the plan's thresholds, or the defaults when it has none
+func GetFraudThresholds(planKey string) (*FraudThresholds, error) {
+	err := refreshFraudConfigIfStale()
+	if err != nil {
+		return nil, err
+	}
+	fraudCache.RLock()
+	defer fraudCache.RUnlock()
+	if value, ok := fraudCache.thresholds[planKey]; ok {
+		return value, nil
+	}
+	value := DefaultFraudThresholds
+	return &value, nil
+}
+
+// getPrefixRisk returns the score of the longest risky prefix number starts with
+func getPrefixRisk(digits string) (string, int) {
+	fraudCache.RLock()
+	defer fraudCache.RUnlock()
+	for i := len(digits); i > 0; i-- {
+		if score, ok := fraudCache.prefixes[digits[:i]]; ok {
+			return digits[:i], score
+		}
+	}
+	return "", 0
+}
+
+func getFraudLocation() *time.Location {
+	if name := os.Getenv("FRAUD_TIMEZONE"); name != "" {
+		loc, err := time.LoadLocation(name)
+		if err == nil {
+			return loc
+		}
+	}
+	return time.UTC
+}
+
+func isQuietHour(hour int, start int, end int) bool {
+	if start == end {
+		return false
+	}
+	if start < end {
+		return hour >= start && hour < end
+	}
+	// window wraps past midnight
+	return hour >= start || hour < end
+}
+
+func fraudCallsKey(workspaceId int, now time.Time) string {
+	return fmt.Sprintf("fraud:calls:%d:%s", workspaceId, now.UTC().Format("200601021504"))
+}
+
+func fraudSpendKey(workspaceId int, now time.Time) string {
+	return fmt.Sprintf("fraud:spend:%d:%s", workspaceId, now.UTC().Format("2006010215"))
+}
+
+func fraudCountriesKey(workspaceId int) string {
+	return fmt.Sprintf("fraud:countries:%d", workspaceId)
+}
+
+// RecordCallSpend adds the cost of a call to the workspace's hourly spend
+func RecordCallSpend(workspaceId int, cents int, now time.Time) error {
+	rdb, err := CreateRedisConn()
+	if err != nil {
+		return err
+	}
+	key := fraudSpendKey(workspaceId, now)
+	err = rdb.IncrBy(key, int64(cents)).Err()
+	if err != nil {
+		return err
+	}
+	return rdb.Expire(key, 2*time.Hour).Err()
+}
+
+// CheckOutboundCall scores a call before it's placed. every check counts towards the
+// workspace's call velocity, and allowed destinations are remembered so later calls
+// to the same country don't score as new.
+func CheckOutboundCall(workspace *Workspace, to string, now time.Time) (*FraudDecision, error) {
+	decision := &FraudDecision{Action: FraudAllow, Signals: make([]FraudSignal, 0)}
+	enabled, err := Can(workspace, FeatureFraudProtection)
+	if err != nil {
+		return nil, err
+	}
+	decision.Enabled = enabled
+	if !enabled {
+		return decision, nil
+	}
+	thresholds, err := GetFraudThresholds(workspace.Plan)
+	if err != nil {
+		return nil, err
+	}
+	destination, err := NormalizeWorkspaceNumber(workspace, to)
+	if err != nil {
+		return nil, err
+	}
+	decision.Destination = destination
+	digits := strings.TrimPrefix(destination.E164, "+")
+
+	switch destination.Type {
+	case NumberTypePremium, NumberTypeSharedCost:
+		decision.add(FraudSignalPremiumDestination, thresholds.PremiumScore, string(destination.Type))
+	}
+	if prefix, score := getPrefixRisk(digits); score > 0 {
+		decision.add(FraudSignalHighRiskPrefix, score, "+"+prefix)
+	}
+
+	rdb, err := CreateRedisConn()
+	if err != nil {
+		return nil, err
+	}
+	callsKey := fraudCallsKey(workspace.Id, now)
+	calls, err := rdb.Incr(callsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	rdb.Expire(callsKey, 2*time.Minute)
+	if int(calls) > thresholds.MaxCallsPerMinute {
+		decision.add(FraudSignalCallVelocity, thresholds.VelocityScore, strconv.FormatInt(calls, 10)+" calls this minute")
+	}
+	spend, err := rdb.Get(fraudSpendKey(workspace.Id, now)).Int64()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	if int(spend) > thresholds.MaxSpendPerHourCents {
+		decision.add(FraudSignalSpendVelocity, thresholds.VelocityScore, strconv.FormatInt(spend, 10)+" cents this hour")
+	}
+
+	hour := now.In(getFraudLocation()).Hour()
+	if isQuietHour(hour, thresholds.QuietHourStart, thresholds.QuietHourEnd) {
+		decision.add(FraudSignalUnusualHour, thresholds.UnusualHourScore, strconv.Itoa(hour)+"h")
+	}
+
+	countriesKey := fraudCountriesKey(workspace.Id)
+	known, err := rdb.SIsMember(countriesKey, destination.Region).Result()
+	if err != nil {
+		return nil, err
+	}
+	if !known && destination.Region != GetWorkspacePhoneRegion(workspace) {
+		decision.add(FraudSignalNewCountry, thresholds.NewCountryScore, destination.Region)
+	}
+
+	if decision.Score >= thresholds.BlockScore {
+		decision.Action = FraudBlock
+	} else if decision.Score >= thresholds.ChallengeScore {
+		decision.Action = FraudChallenge
+	}
+	if decision.Action == FraudAllow {
+		err = rdb.SAdd(countriesKey, destination.Region).Err()
+		if err == nil {
+			rdb.Expire(countriesKey, fraudCountriesTTL)
+		}
+	}
+	return decision, nil
+}
+
+// ApproveFraudChallenge is called once a challenged call was confirmed, so the
+// destination country no longer scores as new
+func ApproveFraudChallenge(workspaceId int, decision *FraudDecision) error {
+	if decision.Destination == nil {
+		return nil
+	}
+	rdb, err := CreateRedisConn()
+	if err != nil {
+		return err
+	}
+	key := fraudCountriesKey(workspaceId)
+	err = rdb.SAdd(key, decision.Destination.Region).Err()
+	if err != nil {
+		return err
+	}
+	return rdb.Expire(key, fraudCountriesTTL).Err()
+}
+
+func SaveFraudDecision(workspaceId int, to string, decision *FraudDecision) error {
+	if decision.Action == FraudAllow {
+		return nil
+	}
+	reasons := make([]string, 0, len(decision.Signals))
+	for _, signal := range decision.Signals {
+		reasons = append(reasons, signal.Name)
+	}
+	_, err := db.Exec("INSERT INTO fraud_events (`workspace_id`, `number`, `action`, `score`, `reasons`, `created_at`) VALUES ( ?, ?, ?, ?, ?, ? )",
+		workspaceId, to, decision.Action, decision.Score, strings.Join(reasons, ","), time.Now())
+	return err
+}
@@ -0,0 +1,109 @@
+package helpers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+type UpgradeRequiredError struct {
+	Feature     Feature `json:"feature"`
+	CurrentPlan string  `json:"current_plan"`
+	// PlanKey and PlanName name the cheapest plan that includes the feature, empty if none does
+	PlanKey  string `json:"plan_key"`
+	PlanName string `json:"plan_name"`
+}
+
+func (e *UpgradeRequiredError) Error() string {
+	if e.PlanKey == "" {
+		return fmt.Sprintf("feature %s is not available on any plan", e.Feature)
+	}
+	return fmt.Sprintf("feature %s requires an upgrade from %s to %s", e.Feature, e.CurrentPlan, e.PlanName)
+}
+
+// cheaperPlan orders plans by price, then rank, then id so suggestions are stable
+func cheaperPlan(a *Entitlements, b *Entitlements) bool {
+	if a.MonthlyCostCents != b.MonthlyCostCents {
+		return a.MonthlyCostCents < b.MonthlyCostCents
+	}
+	if a.Rank != b.Rank {
+		return a.Rank < b.Rank
+	}
+	return a.PlanId < b.PlanId
+}
+
+// CheapestPlanWithFeature returns the cheapest active, public plan including the
+// feature, nil when none does
+func CheapestPlanWithFeature(feature Feature) (*Entitlements, error) {
+	err := RefreshEntitlementsIfStale()
+	if err != nil {
+		return nil, err
+	}
+	entitlementsMu.RLock()
+	defer entitlementsMu.RUnlock()
+	var cheapest *Entitlements
+	for _, entitlements := range entitlementsByPlan {
+		if !entitlements.Offered || !entitlements.Features[feature] {
+			continue
+		}
+		if cheapest == nil || cheaperPlan(entitlements, cheapest) {
+			cheapest = entitlements
+		}
+	}
+	return cheapest, nil
+}
+
+// RequireFeature returns an *UpgradeRequiredError when the workspace's plan doesn't include feature
+func RequireFeature(workspaceId int, feature Feature) error {
+	workspace, err := GetWorkspaceFromDB(workspaceId)
+	if err != nil {
+		return err
+	}
+	ok, err := Can(workspace, feature)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return nil
+	}
+	upgradeErr := &UpgradeRequiredError{Feature: feature, CurrentPlan: workspace.Plan}
+	cheapest, err := CheapestPlanWithFeature(feature)
+	if err != nil {
+		return err
+	}
+	if cheapest != nil {
+		upgradeErr.PlanKey = cheapest.PlanKey
+		upgradeErr.PlanName = cheapest.PlanName
+	}
+	return upgradeErr
+}
+
+// RequireFeatureMiddleware rejects requests with 402 Payment Required when the
+// workspace returned by getWorkspaceId isn't entitled to feature
+func RequireFeatureMiddleware(feature Feature, getWorkspaceId func(r *http.Request) (int, error)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			workspaceId, err := getWorkspaceId(r)
+			if err != nil {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			err = RequireFeature(workspaceId, feature)
+			if upgradeErr, ok := err.(*UpgradeRequiredError); ok {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusPaymentRequired)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"error":   "upgrade_required",
+					"message": upgradeErr.Error(),
+					"details": upgradeErr,
+				})
+				return
+			}
+			if err != nil {
+				HandleInternalErr("could not check plan feature..", err, w)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
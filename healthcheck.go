@@ -0,0 +1,377 @@
+package helpers
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	guuid "github.com/google/uuid"
+)
+
+const (
+	HealthTransportUDP = "udp"
+	HealthTransportTCP = "tcp"
+)
+
+const defaultSIPPort = "5060"
+
+type HealthCheckConfig struct {
+	Interval  time.Duration
+	Timeout   time.Duration
+	Transport string
+	// FailureThreshold is how many probes in a row must fail before a node is unhealthy
+	FailureThreshold int
+}
+
+func DefaultHealthCheckConfig() *HealthCheckConfig {
+	return &HealthCheckConfig{
+		Interval:         5 * time.Second,
+		Timeout:          2 * time.Second,
+		Transport:        HealthTransportUDP,
+		FailureThreshold: 3,
+	}
+}
+
+type HealthTarget struct {
+	Kind    string `json:"kind"`
+	Id      int    `json:"id"`
+	Address string `json:"address"`
+}
+
+// HealthResult is the latest probe outcome for a target. Known is false until a probe
+// succeeds or FailureThreshold probes fail, Healthy means nothing before then.
+type HealthResult struct {
+	Target              HealthTarget  `json:"target"`
+	Known               bool          `json:"known"`
+	Healthy             bool          `json:"healthy"`
+	LastRTT             time.Duration `json:"last_rtt"`
+	LastStatusCode      int           `json:"last_status_code"`
+	LastError           string        `json:"last_error"`
+	ConsecutiveFailures int           `json:"consecutive_failures"`
+	CheckedAt           time.Time     `json:"checked_at"`
+}
+
+type HealthEvent struct {
+	Result  HealthResult `json:"result"`
+	Healthy bool         `json:"healthy"`
+}
+
+func withDefaultSIPPort(address string) string {
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return address
+	}
+	return net.JoinHostPort(strings.Trim(address, "[]"), defaultSIPPort)
+}
+
+func buildSIPOptions(transport string, target string, local string) string {
+	host, _, _ := net.SplitHostPort(target)
+	branch := "z9hG4bK" + strconv.FormatInt(rand.Int63(), 36)
+	tag := strconv.FormatInt(rand.Int63(), 36)
+	lines := []string{
+		"OPTIONS sip:" + host + " SIP/2.0",
+		"Via: SIP/2.0/" + strings.ToUpper(transport) + " " + local + ";branch=" + branch + ";rport",
+		"Max-Forwards: 70",
+		"From: <sip:healthcheck@" + local + ">;tag=" + tag,
+		"To: <sip:" + host + ">",
+		"Call-ID: " + guuid.New().String(),
+		"CSeq: 1 OPTIONS",
+		"Contact: <sip:healthcheck@" + local + ">",
+		"Accept: application/sdp",
+		"Content-Length: 0",
+	}
+	return strings.Join(lines, "\r\n") + "\r\n\r\n"
+}
+
+func parseSIPStatusCode(line string) (int, error) {
+	parts := strings.SplitN(strings.TrimSpace(line), " ", 3)
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "SIP/2.0") {
+		return 0, fmt.Errorf("invalid sip response %q", line)
+	}
+	return strconv.Atoi(parts[1])
+}
+
+// SendSIPOptions pings address with a SIP OPTIONS request and returns the round trip
+// time and response code. any SIP response counts as reachable.
+func SendSIPOptions(transport string, address string, timeout time.Duration) (time.Duration, int, error) {
+	address = withDefaultSIPPort(address)
+	conn, err := net.DialTimeout(transport, address, timeout)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+
+	started := time.Now()
+	conn.SetDeadline(started.Add(timeout))
+	_, err = conn.Write([]byte(buildSIPOptions(transport, address, conn.LocalAddr().String())))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var statusLine string
+	if transport == HealthTransportUDP {
+		buf := make([]byte, 4096)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return 0, 0, err
+		}
+		statusLine = strings.SplitN(string(buf[:n]), "\n", 2)[0]
+	} else {
+		statusLine, err = bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	rtt := time.Since(started)
+	code, err := parseSIPStatusCode(statusLine)
+	if err != nil {
+		return rtt, 0, err
+	}
+	return rtt, code, nil
+}
+
+// HealthChecker probes media servers and SIP routers on an interval and publishes
+// a HealthEvent whenever a node turns healthy or unhealthy
+type HealthChecker struct {
+	Config *HealthCheckConfig
+	// Targets lists the nodes to probe, tests can inject a fixed list
+	Targets func() ([]HealthTarget, error)
+	// OnChange is called once a node's health is first known and whenever it changes
+	// after that, it defaults to writing live_status
+	OnChange func(result *HealthResult) error
+	// OnResult is called after every probe, it defaults to claiming the node's
+	// live_status so gossip doesn't overwrite it
+	OnResult func(result *HealthResult)
+
+	mu       sync.RWMutex
+	results  map[string]*HealthResult
+	watchers map[int]chan HealthEvent
+	nextId   int
+	stop     chan struct{}
+}
+
+func NewHealthChecker(config *HealthCheckConfig, targets func() ([]HealthTarget, error)) *HealthChecker {
+	if config == nil {
+		config = DefaultHealthCheckConfig()
+	}
+	hc := &HealthChecker{
+		Config:   config,
+		Targets:  targets,
+		OnChange: persistHealthResult,
+		results:  make(map[string]*HealthResult),
+		watchers: make(map[int]chan HealthEvent),
+	}
+	hc.OnResult = hc.claimNodeHealth
+	return hc
+}
+
+// CreateHealthChecker probes every media server and SIP router in the database
+func CreateHealthChecker(config *HealthCheckConfig) *HealthChecker {
+	return NewHealthChecker(config, GetHealthTargets)
+}
+
+func GetHealthTargets() ([]HealthTarget, error) {
+	targets := make([]HealthTarget, 0)
+	servers, err := CreateMediaServers()
+	if err != nil {
+		return nil, err
+	}
+	for _, server := range servers {
+		targets = append(targets, HealthTarget{Kind: MemberKindMediaServer, Id: server.Id, Address: server.IpAddress})
+	}
+	routers, err := GetSIPRouters()
+	if err != nil {
+		return nil, err
+	}
+	for _, router := range routers {
+		targets = append(targets, HealthTarget{Kind: MemberKindSIPRouter, Id: router.Id, Address: router.IpAddress})
+	}
+	return targets, nil
+}
+
+func healthKey(target HealthTarget) string {
+	return target.Kind + ":" + strconv.Itoa(target.Id)
+}
+
+// Probe checks one target and records the outcome
+func (hc *HealthChecker) Probe(target HealthTarget) HealthResult {
+	rtt, code, err := SendSIPOptions(hc.Config.Transport, target.Address, hc.Config.Timeout)
+
+	hc.mu.Lock()
+	result, ok := hc.results[healthKey(target)]
+	if !ok {
+		// nodes start unknown, whatever was stored before a restart is confirmed or
+		// corrected by the first settled result
+		result = &HealthResult{Target: target}
+		hc.results[healthKey(target)] = result
+	}
+	wasKnown := result.Known
+	wasHealthy := result.Healthy
+	result.Target = target
+	result.CheckedAt = time.Now()
+	if err != nil {
+		result.ConsecutiveFailures++
+		result.LastError = err.Error()
+		if result.ConsecutiveFailures >= hc.Config.FailureThreshold {
+			result.Known = true
+			result.Healthy = false
+		}
+	} else {
+		result.ConsecutiveFailures = 0
+		result.LastError = ""
+		result.LastRTT = rtt
+		result.LastStatusCode = code
+		result.Known = true
+		result.Healthy = true
+	}
+	snapshot := *result
+	changed := result.Known && (!wasKnown || wasHealthy != result.Healthy)
+	if changed {
+		event := HealthEvent{Result: snapshot, Healthy: result.Healthy}
+		for _, watcher := range hc.watchers {
+			select {
+			case watcher <- event:
+			default:
+			}
+		}
+	}
+	hc.mu.Unlock()
+
+	if hc.OnResult != nil {
+		hc.OnResult(&snapshot)
+	}
+	if changed && hc.OnChange != nil {
+		err = hc.OnChange(&snapshot)
+		if err != nil {
+			fmt.Printf("could not publish health of %s %d: %v\r\n", target.Kind, target.Id, err)
+		}
+	}
+	return snapshot
+}
+
+// RunOnce probes all targets concurrently and waits for them to finish
+func (hc *HealthChecker) RunOnce() error {
+	targets, err := hc.Targets()
+	if err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	for _, target := range targets {
+		wg.Add(1)
+		go func(target HealthTarget) {
+			defer wg.Done()
+			hc.Probe(target)
+		}(target)
+	}
+	wg.Wait()
+	return nil
+}
+
+func (hc *HealthChecker) Start() {
+	hc.mu.Lock()
+	if hc.stop != nil {
+		hc.mu.Unlock()
+		return
+	}
+	stop := make(chan struct{})
+	hc.stop = stop
+	hc.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(hc.Config.Interval)
+		defer ticker.Stop()
+		for {
+			err := hc.RunOnce()
+			if err != nil {
+				fmt.Printf("could not run health checks: %v\r\n", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+func (hc *HealthChecker) Stop() {
+	hc.mu.Lock()
+	stop := hc.stop
+	hc.stop = nil
+	hc.mu.Unlock()
+	if stop != nil {
+		close(stop)
+	}
+}
+
+// Watch returns a channel of health changes and a function to stop watching
+func (hc *HealthChecker) Watch() (<-chan HealthEvent, func()) {
+	ch := make(chan HealthEvent, 64)
+	hc.mu.Lock()
+	id := hc.nextId
+	hc.nextId++
+	hc.watchers[id] = ch
+	hc.mu.Unlock()
+	return ch, func() {
+		hc.mu.Lock()
+		if _, ok := hc.watchers[id]; ok {
+			delete(hc.watchers, id)
+			close(ch)
+		}
+		hc.mu.Unlock()
+	}
+}
+
+func (hc *HealthChecker) Results() []HealthResult {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+	results := make([]HealthResult, 0, len(hc.results))
+	for _, result := range hc.results {
+		results = append(results, *result)
+	}
+	return results
+}
+
+func healthClaimKey(kind string, id int) string {
+	return "health_claim:" + kind + ":" + strconv.Itoa(id)
+}
+
+// claimNodeHealth marks the node as probed. while the claim lasts the health checker
+// takes precedence over gossip for its live_status.
+func (hc *HealthChecker) claimNodeHealth(result *HealthResult) {
+	rdb, err := CreateRedisConn()
+	if err != nil {
+		return
+	}
+	// outlive a few missed rounds so a slow probe doesn't hand the node back to gossip
+	ttl := 3 * (hc.Config.Interval + hc.Config.Timeout)
+	err = rdb.Set(healthClaimKey(result.Target.Kind, result.Target.Id), 1, ttl).Err()
+	if err != nil {
+		fmt.Printf("could not claim health of %s %d: %v\r\n", result.Target.Kind, result.Target.Id, err)
+	}
+}
+
+// IsNodeHealthClaimed tells whether a health checker is currently probing the node
+func IsNodeHealthClaimed(kind string, id int) (bool, error) {
+	rdb, err := CreateRedisConn()
+	if err != nil {
+		return false, err
+	}
+	count, err := rdb.Exists(healthClaimKey(kind, id)).Result()
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func persistHealthResult(result *HealthResult) error {
+	status := NodeStatusOnline
+	if !result.Healthy {
+		status = NodeStatusUnhealthy
+	}
+	return SetNodeHealth(result.Target.Kind, result.Target.Id, status)
+}
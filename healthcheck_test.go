@@ -0,0 +1,106 @@
+package helpers
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startSIPStandIn answers every OPTIONS datagram with response
+func startSIPStandIn(t *testing.T, response string) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if !strings.HasPrefix(string(buf[:n]), "OPTIONS sip:") {
+				continue
+			}
+			conn.WriteTo([]byte(response), addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func unusedUDPAddress(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := conn.LocalAddr().String()
+	conn.Close()
+	return address
+}
+
+func newTestHealthChecker(changes *[]HealthResult) *HealthChecker {
+	hc := NewHealthChecker(&HealthCheckConfig{Interval: time.Second, Timeout: 300 * time.Millisecond, Transport: HealthTransportUDP, FailureThreshold: 2}, nil)
+	hc.OnResult = nil
+	hc.OnChange = func(result *HealthResult) error {
+		*changes = append(*changes, *result)
+		return nil
+	}
+	return hc
+}
+
+func TestSendSIPOptionsUDP(t *testing.T) {
+	address := startSIPStandIn(t, "SIP/2.0 200 OK\r\nContent-Length: 0\r\n\r\n")
+	rtt, code, err := SendSIPOptions(HealthTransportUDP, address, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != 200 {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if rtt <= 0 {
+		t.Fatalf("expected a round trip time, got %v", rtt)
+	}
+}
+
+func TestSendSIPOptionsInvalidResponse(t *testing.T) {
+	address := startSIPStandIn(t, "HTTP/1.1 200 OK\r\n\r\n")
+	_, _, err := SendSIPOptions(HealthTransportUDP, address, time.Second)
+	if err == nil {
+		t.Fatal("expected an error for a non SIP response")
+	}
+}
+
+func TestProbePersistsFirstHealthyResult(t *testing.T) {
+	var changes []HealthResult
+	hc := newTestHealthChecker(&changes)
+	target := HealthTarget{Kind: MemberKindMediaServer, Id: 1, Address: startSIPStandIn(t, "SIP/2.0 200 OK\r\n\r\n")}
+
+	result := hc.Probe(target)
+	if !result.Known || !result.Healthy {
+		t.Fatalf("expected a known healthy result, got %+v", result)
+	}
+	hc.Probe(target)
+	if len(changes) != 1 || !changes[0].Healthy {
+		t.Fatalf("expected the first result to be published once, got %+v", changes)
+	}
+}
+
+func TestProbeUnhealthyAfterThreshold(t *testing.T) {
+	var changes []HealthResult
+	hc := newTestHealthChecker(&changes)
+	target := HealthTarget{Kind: MemberKindSIPRouter, Id: 2, Address: unusedUDPAddress(t)}
+
+	result := hc.Probe(target)
+	if result.Known {
+		t.Fatalf("expected the node to stay unknown below the threshold, got %+v", result)
+	}
+	result = hc.Probe(target)
+	if !result.Known || result.Healthy {
+		t.Fatalf("expected a known unhealthy result, got %+v", result)
+	}
+	if len(changes) != 1 || changes[0].Healthy {
+		t.Fatalf("expected one unhealthy change, got %+v", changes)
+	}
+}
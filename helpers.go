@@ -30,11 +30,8 @@ import (
 	now "github.com/jinzhu/now"
 	"github.com/mailgun/mailgun-go/v4"
 	"github.com/sirupsen/logrus"
-	"github.com/stripe/stripe-go/v71"
-	"github.com/stripe/stripe-go/v71/charge"
 	"github.com/go-redis/redis"
 	easy "github.com/t-tomalak/logrus-easy-formatter"
-	libphonenumber "github.com/ttacon/libphonenumber"
 )
 
 type Call struct {
@@ -308,10 +305,13 @@ type ServicePlan struct {
 	DeletedAt                   *time.Time `json:"deleted_at"`
 	PaypalPlanId                *string    `json:"paypal_plan_id"`
 	PaypalAnnualPlanId          *string    `json:"paypal_annual_plan_id"`
+	StripePlanId                *string    `json:"stripe_plan_id"`
+	StripeAnnualPlanId          *string    `json:"stripe_annual_plan_id"`
 	Status                      string     `json:"status"`
 	FreeTrialExempt             bool       `json:"free_trial_exempt"`
 	AllowMultipleWorkspaceUsers bool       `json:"allow_multiple_workspace_users"`
 	TrialEndsOnPurchase         bool       `json:"trial_ends_on_purchase"`
+	FreeTrialDays               int        `json:"free_trial_days"`
 }
 
 type SubscriptionWithPlan struct {
@@ -337,6 +337,9 @@ type Subscription struct {
 	AutoTopupEnabled       bool       `json:"auto_topup_enabled"`
 	AutoTopupThreshold     int        `json:"auto_topup_threshold"`
 	AutoTopupAmount        int        `json:"auto_topup_amount"`
+	BillingAnchorDay       int        `json:"billing_anchor_day"`
+	FreeTrialStartDate     *time.Time `json:"free_trial_start_date"`
+	FreeTrialEndDate       *time.Time `json:"free_trial_end_date"`
 }
 
 type SubscriptionWithWorkspace struct {
@@ -344,13 +347,6 @@ type SubscriptionWithWorkspace struct {
 	Workspace    *Workspace    `json:"workspace"`
 }
 
-type PlanValue struct {
-	Kind        string
-	ValueBool   bool
-	ValueString string
-	ValueInt    int
-	ValueFloat  float64
-}
 type WorkspaceBillingInfo struct {
 	InvoiceDue            string
 	NextInvoiceDue        string
@@ -364,7 +360,8 @@ type BaseCosts struct {
 	FaxPerUsed        float64
 }
 type BaseConfig struct {
-	StripeKey string
+	StripeKey           string
+	StripeWebhookSecret string
 }
 type DIDNumber struct {
 	Number      string `json:"number"`
@@ -382,9 +379,13 @@ type MediaServer struct {
 	Node             *smudge.Node
 }
 type SIPRouter struct {
-	Id               int    `json:"id"`
-	IpAddress        string `json:"ip_address"`
-	PrivateIpAddress string `json:"private_ip_address"`
+	Id               int     `json:"id"`
+	IpAddress        string  `json:"ip_address"`
+	PrivateIpAddress string  `json:"private_ip_address"`
+	Region           string  `json:"region"`
+	Status           string  `json:"status"`
+	LiveCallCount    int     `json:"live_call_count"`
+	LiveCPUPCTUsed   float64 `json:"live_cpu_pct_used"`
 	Node             *smudge.Node
 }
 
@@ -440,6 +441,7 @@ type APICredentials struct {
 }
 
 var db *sql.DB
+var ErrSubscriptionNotFound = errors.New("subscription not found")
 var rdb *redis.Client
 
 // var servers []*MediaServer;
@@ -523,57 +525,27 @@ func CreateMediaServers() ([]*MediaServer, error) {
 	return servers, nil
 }
 
-func GetSIPRouter(region string) (*SIPRouter, error) {
+func GetMediaServer(id int) (*MediaServer, error) {
 	db, err := CreateDBConn()
 	if err != nil {
 		return nil, err
 	}
-
-	results, err := db.Query("SELECT id,ip_address,private_ip_address FROM sip_routers WHERE region = ?", region)
-	//results, err := db.Query("SELECT ip_address,private_ip_address FROM sip_routers")
+	value := MediaServer{}
+	row := db.QueryRow("SELECT id,ip_address,private_ip_address,webrtc_optimized,live_call_count,live_cpu_pct_used,live_status FROM media_servers WHERE id = ?", id)
+	err = row.Scan(&value.Id, &value.IpAddress, &value.PrivateIpAddress, &value.RtcOptimized, &value.LiveCallCount, &value.LiveCPUPCTUsed, &value.Status)
 	if err != nil {
 		return nil, err
 	}
-	defer results.Close()
-
-	var value SIPRouter
-	for results.Next() {
-		value = SIPRouter{}
-		err := results.Scan(&value.Id, &value.IpAddress, &value.PrivateIpAddress)
-		if err != nil {
-			return nil, err
-		}
-		node, err := smudge.CreateNodeByAddress(value.IpAddress)
-		if err != nil {
-			return nil, err
-		}
-		value.Node = node
-	}
 	return &value, nil
 }
 
-func GetSIPRouters() ([]*SIPRouter, error) {
-	db, err := CreateDBConn()
-	if err != nil {
-		return nil, err
-	}
-
-	results, err := db.Query("SELECT ip_address,private_ip_address FROM sip_routers")
-	if err != nil {
-		return nil, err
-	}
-	defer results.Close()
+// GetSIPRouter returns the best router for region, falling back to nearby regions
+func GetSIPRouter(region string) (*SIPRouter, error) {
+	return SelectSIPRouter(region)
+}
 
-	var values []*SIPRouter
-	for results.Next() {
-		value := SIPRouter{}
-		err := results.Scan(&value.IpAddress, &value.PrivateIpAddress)
-		if err != nil {
-			return nil, err
-		}
-		values = append(values, &value)
-	}
-	return values, nil
+func GetSIPRouters() ([]*SIPRouter, error) {
+	return querySIPRouters("")
 }
 
 func HandleInternalErr(msg string, err error, w http.ResponseWriter) {
@@ -1160,7 +1132,7 @@ func GetAPICredentials() (*APICredentials, error) {
 
 func GetRecordingSpace(id int) (int, error) {
 	var bytes int
-	row := db.QueryRow(`SELECT SUM(size) FROM recordings WHERE workspace_id=?`, id)
+	row := db.QueryRow(`SELECT COALESCE(SUM(size), 0) FROM recordings WHERE workspace_id=?`, id)
 
 	err := row.Scan(&bytes)
 	if err == sql.ErrNoRows { //create conference
@@ -1262,33 +1234,25 @@ func GetRecordingFromDB(id int) (*Recording, error) {
 	return &Recording{APIId: apiId, Id: id, Size: size}, nil
 }
 
-// todo move to microservice
 func GetPlanRecordingLimit(workspace *Workspace) (int, error) {
-	if workspace.Plan == "pay-as-you-go" {
-		return 1024, nil
-	} else if workspace.Plan == "starter" {
-		return 1024 * 2, nil
-	} else if workspace.Plan == "pro" {
-		return 1024 * 32, nil
-	} else if workspace.Plan == "starter" {
-		return 1024 * 128, nil
+	entitlements, err := GetEntitlements(workspace)
+	if err != nil {
+		return 0, err
 	}
-	return 0, nil
+	return entitlements.Limits.RecordingSpaceKb, nil
 }
 
-// todo move to microservice
+// GetPlanFaxLimit returns nil when the plan allows unlimited faxes
 func GetPlanFaxLimit(workspace *Workspace) (*int, error) {
-	var res *int
-	if workspace.Plan == "pay-as-you-go" {
-		*res = 100
-	} else if workspace.Plan == "starter" {
-		*res = 100
-	} else if workspace.Plan == "pro" {
-		res = nil
-	} else if workspace.Plan == "starter" {
-		res = nil
-	}
-	return res, nil
+	entitlements, err := GetEntitlements(workspace)
+	if err != nil {
+		return nil, err
+	}
+	if entitlements.Limits.UnlimitedFax {
+		return nil, nil
+	}
+	limit := entitlements.Limits.Faxes
+	return &limit, nil
 }
 func SendLogRoutineEmail(log *LogRoutine, user *User, workspace *Workspace) error {
 	mg := mailgun.NewMailgun(os.Getenv("MAILGUN_DOMAIN"), os.Getenv("MAILGUN_API_KEY"))
@@ -1377,113 +1341,50 @@ func ShouldUseProviderNext(name string, ipPrivate string) (bool, error) {
 	return true, nil
 }
 func CheckCIDRMatch(sourceIp string, fullIp string) (bool, error) {
-	_, net1, err := net.ParseCIDR(sourceIp + "/32")
-	if err != nil {
-		return false, err
+	ip := net.ParseIP(sourceIp)
+	if ip == nil {
+		return false, fmt.Errorf("invalid source ip %s", sourceIp)
 	}
-	_, net2, err := net.ParseCIDR(fullIp)
+	network, err := ParseIPNetwork(fullIp)
 	if err != nil {
 		return false, err
 	}
-
-	return net2.Contains(net1.IP), nil
+	return network.Contains(ip), nil
 }
 func CheckPSTNIPWhitelist(did string, sourceIp string) (bool, error) {
-	results, err := db.Query(`SELECT 
-	sip_providers_whitelist_ips.ip_address, 
-	sip_providers_whitelist_ips.ip_address_range
-	FROM sip_providers_whitelist_ips
-	INNER JOIN sip_providers ON sip_providers.id = sip_providers_whitelist_ips.provider_id
-	INNER JOIN did_numbers ON did_numbers.workspace_id = sip_providers_whitelist_ips.workspace_id
-	WHERE did_numbers.api_number = ?
-	`, did)
+	rule, err := MatchIPWhitelist(IPRuleSourceProvider, did, sourceIp)
 	if err != nil {
 		return false, err
 	}
-	defer results.Close()
-	for results.Next() {
-		var ipAddr string
-		var ipAddrRange string
-		err = results.Scan(&ipAddr, &ipAddrRange)
-		if err != nil {
-			return false, err
-
-		}
-		fullIp := ipAddr + ipAddrRange
-		match, err := CheckCIDRMatch(sourceIp, fullIp)
-		if err != nil {
-			fmt.Printf("error matching CIDR source %s, full %s\r\n", sourceIp, fullIp)
-			continue
-		}
-		if match {
-			return true, nil
-		}
-	}
-	return false, nil
+	return rule != nil, nil
 }
 func CheckBYOPSTNIPWhitelist(did string, sourceIp string) (bool, error) {
-	results, err := db.Query(`SELECT 
-	byo_carriers_ips.ip,
-	byo_carriers_ips.range
-	FROM byo_carriers_ips
-	INNER JOIN byo_carriers ON byo_carriers.id = byo_carriers_ips.carrier_id
-	INNER JOIN byo_did_numbers ON byo_did_numbers.workspace_id = byo_carriers.workspace_id
-	WHERE byo_did_numbers.number = ?
-	`, did)
+	rule, err := MatchIPWhitelist(IPRuleSourceBYO, did, sourceIp)
 	if err != nil {
 		return false, err
 	}
-	defer results.Close()
-	for results.Next() {
-		var ipAddr string
-		var ipAddrRange string
-		err = results.Scan(&ipAddr, &ipAddrRange)
-		if err != nil {
-			return false, err
-		}
-		fullIp := ipAddr + ipAddrRange
-		match, err := CheckCIDRMatch(sourceIp, fullIp)
-		if err != nil {
-			fmt.Printf("error matching CIDR source %s, full %s\r\n", sourceIp, fullIp)
-			continue
-		}
-		if match {
-			return true, nil
-		}
-	}
-	return false, nil
+	return rule != nil, nil
 }
 
+// FinishValidation returns false when the caller is on the workspace's blocklist
 func FinishValidation(number string, didWorkspaceId string) (bool, error) {
-	num, err := libphonenumber.Parse(number, "US")
+	workspaceId, err := strconv.Atoi(didWorkspaceId)
 	if err != nil {
 		return false, err
 	}
-	formattedNum := libphonenumber.Format(num, libphonenumber.E164)
-	row := db.QueryRow("SELECT id FROM `blocked_numbers` WHERE `workspace_id` = ? AND `number` = ?", didWorkspaceId, formattedNum)
-	var id string
-	err = row.Scan(&id)
-	if err == sql.ErrNoRows { //create conference
-		return true, nil
-	}
+	_, blocked, err := MatchBlocklist(workspaceId, number, time.Now())
 	if err != nil {
 		return false, err
 	}
-	return false, nil
+	return !blocked, nil
 }
+// CheckFreeTrialStatus evaluates a trial plan started at started using the default trial length
 func CheckFreeTrialStatus(plan string, started time.Time) string {
-	if plan == "trial" {
-		now := time.Now()
-		//make configurable
-		expireDays := 10
-		expireHours := expireDays * 24
-		started.Add(time.Hour * time.Duration(expireHours))
-		if started.After(now) {
-			return "expired"
-		}
-		return "pending-expiry"
+	if plan != "trial" {
+		return string(TrialNotApplicable)
 	}
-	return "not-applicable"
+	end := started.AddDate(0, 0, DefaultTrialDays)
+	return string(evaluateTrialWindow(started, end, time.Now()).State)
 }
 func ProcessUsersFirstCall(call Call) {
 	var id string
@@ -1503,21 +1404,9 @@ func ProcessUsersFirstCall(call Call) {
 }
 func SendEmail(user *User, subject string, body string) {
 }
+// SomeLoadBalancingLogic picks a media server for a new call with the configured strategy
 func SomeLoadBalancingLogic() (*MediaServer, error) {
-	results, err := db.Query("SELECT id,ip_address,private_ip_address,live_call_count,live_cpu_pct_used,live_status FROM media_servers")
-	if err != nil {
-		return nil, err
-	}
-	defer results.Close()
-	for results.Next() {
-		value := MediaServer{}
-		err = results.Scan(&value.Id, &value.IpAddress, &value.PrivateIpAddress, &value.LiveCallCount, &value.LiveCPUPCTUsed, &value.Status)
-		if err != nil {
-			return nil, err
-		}
-		return &value, nil
-	}
-	return nil, nil
+	return SelectMediaServer(nil)
 }
 func DoVerifyCaller(workspaceId int, number string) (bool, error) {
 	var workspace *Workspace
@@ -1531,20 +1420,13 @@ func DoVerifyCaller(workspaceId int, number string) (bool, error) {
 		return false, err
 	}
 
-	num, err := libphonenumber.Parse(number, "US")
+	fmt.Printf("looking up number %s\r\n", number)
+	fmt.Printf("domain isr %s\r\n", workspace.Name)
+	result, err := VerifyCallerId(workspace, number)
 	if err != nil {
 		return false, err
 	}
-	formattedNum := libphonenumber.Format(num, libphonenumber.E164)
-	fmt.Printf("looking up number %s\r\n", formattedNum)
-	fmt.Printf("domain isr %s\r\n", workspace.Name)
-	var id string
-	row := db.QueryRow("SELECT id FROM `did_numbers` WHERE `number` = ? AND `workspace_id` = ?", formattedNum, workspace.Id)
-	err = row.Scan(&id)
-	if err != sql.ErrNoRows { //create conference
-		return true, nil
-	}
-	return false, nil
+	return result.Verified, nil
 }
 
 func GetQueryVariable(r *http.Request, key string) *string {
@@ -1597,63 +1479,16 @@ func ToCents(dollars float64) int {
 	return int(result)
 }
 
+// GetServicePlans returns the plans defined in service_plans, live plans come before
+// inactive and deleted ones, then by rank
 func GetServicePlans() ([]ServicePlan, error) {
-	plans := []ServicePlan{}
-
-	extras := make(map[string]PlanValue)
-	plans = append(plans, createPlan("pay-as-you-go", extras))
-
-	extras = make(map[string]PlanValue)
-	extras["BaseCosts"] = PlanValue{ValueFloat: 24.99}
-	extras["MinutesPerMonth"] = PlanValue{ValueFloat: 200.0}
-	extras["RecordingSpace"] = PlanValue{ValueFloat: float64(convertGbToKb(2))}
-	extras["ImIntegrations"] = PlanValue{ValueBool: true}
-	extras["ProductivityIntegrations"] = PlanValue{ValueBool: true}
-	plans = append(plans, createPlan("starter", extras))
-
-	extras = make(map[string]PlanValue)
-	extras["BaseCosts"] = PlanValue{ValueFloat: 49.99}
-	extras["MinutesPerMonth"] = PlanValue{ValueFloat: 250.0}
-	extras["RecordingSpace"] = PlanValue{ValueFloat: float64(convertGbToKb(32))}
-	extras["Extensions"] = PlanValue{ValueInt: 25}
-	extras["ImIntegrations"] = PlanValue{ValueBool: true}
-	extras["VoiceAnalytics"] = PlanValue{ValueBool: true}
-	extras["FraudProtection"] = PlanValue{ValueBool: true}
-	extras["CrmIntegrations"] = PlanValue{ValueBool: true}
-	extras["ProgrammableToolkit"] = PlanValue{ValueBool: true}
-	extras["Sso"] = PlanValue{ValueBool: true}
-	extras["Provisioner"] = PlanValue{ValueBool: true}
-	extras["Vpn"] = PlanValue{ValueBool: true}
-	extras["MultipleSipDomains"] = PlanValue{ValueBool: true}
-	extras["BringCarrier"] = PlanValue{ValueBool: true}
-	plans = append(plans, createPlan("pro", extras))
-
-	extras = make(map[string]PlanValue)
-	extras["BaseCosts"] = PlanValue{ValueFloat: 69.99}
-	extras["MinutesPerMonth"] = PlanValue{ValueFloat: 500.0}
-	extras["RecordingSpace"] = PlanValue{ValueFloat: float64(convertGbToKb(128))}
-	extras["Extensions"] = PlanValue{ValueInt: 100}
-	extras["ImIntegrations"] = PlanValue{ValueBool: true}
-	extras["VoiceAnalytics"] = PlanValue{ValueBool: true}
-	extras["FraudProtection"] = PlanValue{ValueBool: true}
-	extras["CrmIntegrations"] = PlanValue{ValueBool: true}
-	extras["ProgrammableToolkit"] = PlanValue{ValueBool: true}
-	extras["Sso"] = PlanValue{ValueBool: true}
-	extras["Provisioner"] = PlanValue{ValueBool: true}
-	extras["Vpn"] = PlanValue{ValueBool: true}
-	extras["MultipleSipDomains"] = PlanValue{ValueBool: true}
-	extras["BringCarrier"] = PlanValue{ValueBool: true}
-	extras["CallCenter"] = PlanValue{ValueBool: true}
-	extras["247Support"] = PlanValue{ValueBool: true}
-	extras["AiCalls"] = PlanValue{ValueBool: true}
-	plans = append(plans, createPlan("ultimate", extras))
-
-	return plans, nil
+	return GetServicePlans2()
 }
 
 func GetServicePlans2() ([]ServicePlan, error) {
 
-	results, err := db.Query(`SELECT id, nice_name, key_name, monthly_cost_cents, annual_cost_cents, minutes_per_month, recording_space, extensions, im_integrations, voice_analytics, fraud_protection, crm_integrations, programmable_toolkit, sso, provisioner, vpn, multiple_sip_domains, bring_carrier, 247_support, ai_calls, pay_as_you_go FROM service_plans`)
+	results, err := db.Query(`SELECT id, nice_name, key_name, monthly_cost_cents, annual_cost_cents, minutes_per_month, recording_space, extensions, im_integrations, voice_analytics, fraud_protection, crm_integrations, programmable_toolkit, sso, provisioner, vpn, multiple_sip_domains, bring_carrier, 247_support, ai_calls, pay_as_you_go, paypal_plan_id, paypal_annual_plan_id, stripe_plan_id, stripe_annual_plan_id, ports, fax, unlimited_fax, unlimited_extensions, productivity_integrations, call_center, service_plans.rank, trial_ends_on_purchase, free_trial_exempt, free_trial_days, include_in_pricing_pages, status, deleted_at, base_costs FROM service_plans
+		ORDER BY deleted_at IS NOT NULL, COALESCE(NULLIF(status, ''), ?) <> ?, service_plans.rank, id`, ServicePlanStatusActive, ServicePlanStatusActive)
 	if err != nil {
 		return nil, err
 	}
@@ -1662,6 +1497,18 @@ func GetServicePlans2() ([]ServicePlan, error) {
 	for results.Next() {
 		plan := ServicePlan{}
 		var recordingSpace sql.NullString
+		var paypalPlanId sql.NullString
+		var paypalAnnualPlanId sql.NullString
+		var stripePlanId sql.NullString
+		var stripeAnnualPlanId sql.NullString
+		var ports sql.NullInt64
+		var fax sql.NullInt64
+		var rank sql.NullInt64
+		var freeTrialDays sql.NullInt64
+		var includeInPricingPages sql.NullBool
+		var status sql.NullString
+		var deletedAt sql.NullTime
+		var baseCosts sql.NullFloat64
 		err = results.Scan(
 			&plan.Id,
 			&plan.NiceName,
@@ -1684,6 +1531,24 @@ func GetServicePlans2() ([]ServicePlan, error) {
 			&plan.TwentyFourSevenSupport,
 			&plan.AiCalls,
 			&plan.PayAsYouGo,
+			&paypalPlanId,
+			&paypalAnnualPlanId,
+			&stripePlanId,
+			&stripeAnnualPlanId,
+			&ports,
+			&fax,
+			&plan.UnlimitedFax,
+			&plan.UnlimitedExtensions,
+			&plan.ProductivityIntegrations,
+			&plan.CallCenter,
+			&rank,
+			&plan.TrialEndsOnPurchase,
+			&plan.FreeTrialExempt,
+			&freeTrialDays,
+			&includeInPricingPages,
+			&status,
+			&deletedAt,
+			&baseCosts,
 		)
 		if err != nil {
 			return nil, err
@@ -1691,10 +1556,45 @@ func GetServicePlans2() ([]ServicePlan, error) {
 		if recordingSpace.Valid {
 			plan.RecordingSpace, _ = strconv.ParseFloat(recordingSpace.String, 64)
 		}
+		if paypalPlanId.Valid {
+			plan.PaypalPlanId = &paypalPlanId.String
+		}
+		if paypalAnnualPlanId.Valid {
+			plan.PaypalAnnualPlanId = &paypalAnnualPlanId.String
+		}
+		if stripePlanId.Valid {
+			plan.StripePlanId = &stripePlanId.String
+		}
+		if stripeAnnualPlanId.Valid {
+			plan.StripeAnnualPlanId = &stripeAnnualPlanId.String
+		}
+		plan.Ports = int(ports.Int64)
+		plan.Fax = int(fax.Int64)
+		plan.Rank = int(rank.Int64)
+		plan.FreeTrialDays = int(freeTrialDays.Int64)
+		plan.IncludeInPricingPages = includeInPricingPages.Bool
+		plan.Status = status.String
+		plan.BaseCosts = baseCosts.Float64
+		if deletedAt.Valid {
+			plan.DeletedAt = &deletedAt.Time
+		}
+		plan.Config247Support = plan.TwentyFourSevenSupport
 		plans = append(plans, plan)
 	}
 	return plans, nil
 }
+func GetServicePlan(id int) (*ServicePlan, error) {
+	plans, err := GetServicePlans2()
+	if err != nil {
+		return nil, err
+	}
+	for i := range plans {
+		if plans[i].Id == id {
+			return &plans[i], nil
+		}
+	}
+	return nil, fmt.Errorf("service plan %d not found", id)
+}
 func GetWorkspaceBillingInfo(workspace *Workspace) (*WorkspaceBillingInfo, error) {
 	var info WorkspaceBillingInfo
 
@@ -1786,69 +1686,18 @@ func GetBaseCosts() (*BaseCosts, error) {
 	return &costs, nil
 }
 func GetBaseConfig() (*BaseConfig, error) {
-	config := BaseConfig{StripeKey: os.Getenv("STRIPE_KEY")}
-	return &config, nil
-}
-func ChargeCustomer(user *User, workspace *Workspace, cents int, desc string) error {
-	config, err := GetBaseConfig()
-	if err != nil {
-		return err
-	}
-
-	stripe.Key = config.StripeKey
-
-	var id int
-	var tokenId string
-	row := db.QueryRow(`SELECT id, stripe_id FROM users_cards WHERE workspace_id=? AND primary =1`, workspace.Id)
-
-	err = row.Scan(&id, &tokenId)
-	// `source` is obtained with Stripe.js; see https://stripe.com/docs/payments/accept-a-payment-charges#web-create-token
-	params := &stripe.ChargeParams{Amount: stripe.Int64(int64(cents)),
-		Currency:    stripe.String(string(stripe.CurrencyUSD)),
-		Description: stripe.String(desc),
-		Source:      &stripe.SourceParams{Token: stripe.String(tokenId)}}
-	_, err = charge.New(params)
-	if err != nil {
-		return err
+	config := BaseConfig{
+		StripeKey:           os.Getenv("STRIPE_KEY"),
+		StripeWebhookSecret: os.Getenv("STRIPE_WEBHOOK_SECRET"),
 	}
-	return nil
+	return &config, nil
 }
-
 func IsWorkspaceSuspended(workspaceId int) (bool, error) {
-	gracePeriod := 7 * 24 * time.Hour // 7 days default
-	
-	rows, err := db.Query(`SELECT suspended_at, grace_period_extension FROM workspaces_suspensions WHERE workspace_id = ?`, workspaceId)
+	status, err := GetSuspensionStatus(workspaceId, time.Now())
 	if err != nil {
 		return false, err
 	}
-	defer rows.Close()
-	
-	now := time.Now()
-	
-	for rows.Next() {
-		var suspendedAt time.Time
-		var gracePeriodExtension sql.NullInt64
-		
-		err := rows.Scan(&suspendedAt, &gracePeriodExtension)
-		if err != nil {
-			return false, err
-		}
-		
-		extension := int64(0)
-		if gracePeriodExtension.Valid {
-			extension = gracePeriodExtension.Int64
-		}
-		
-		totalGracePeriod := gracePeriod + time.Duration(extension)*time.Hour
-		
-		suspensionDeadline := suspendedAt.Add(totalGracePeriod)
-		
-		if now.After(suspensionDeadline) {
-			return true, nil
-		}
-	}
-	
-	return false, rows.Err()
+	return status.State == SuspensionStateSuspended, nil
 }
 
 func inMonth(created string, start time.Time, end time.Time) (bool, error) {
@@ -1871,184 +1720,13 @@ func inMonth(created string, start time.Time, end time.Time) (bool, error) {
 	result = !start.After(check) || !end.Before(check)
 	return result, nil
 }
-func convertGbToKb(gb int) int {
-	return gb * 1024
-}
-func convertMinutesToSeconds(min int) int {
-	return min * 60
-}
-
-func createPlan(name string, extras map[string]PlanValue) ServicePlan {
-	plan := ServicePlan{BaseCosts: 0,
-		MinutesPerMonth:          0.0,
-		Extensions:               5,
-		Ports:                    0,
-		RecordingSpace:           1024.0,
-		Fax:                      100,
-		Porting:                  true,
-		CallingBetweenExt:        true,
-		StandardCallFeat:         true,
-		VoicemailTranscriptions:  false,
-		ImIntegrations:           false,
-		ProductivityIntegrations: false,
-		VoiceAnalytics:           false,
-		FraudProtection:          false,
-		CrmIntegrations:          false,
-		ProgrammableToolkit:      false,
-		Sso:                      false,
-		Provisioner:              false,
-		Vpn:                      false,
-		MultipleSipDomains:       false,
-		BringCarrier:             false,
-		CallCenter:               false,
-		Config247Support:         false,
-		AiCalls:                  false}
-
-	plan.NiceName = name
-	if val, ok := extras["BaseCosts"]; ok {
-		//do something here
-		plan.BaseCosts = val.ValueFloat
-	}
-	if val, ok := extras["MinutesPerMonth"]; ok {
-		//do something here
-		plan.MinutesPerMonth = val.ValueFloat
-	}
-	if val, ok := extras["RecordingSpace"]; ok {
-		//do something here
-		plan.RecordingSpace = val.ValueFloat
-	}
-	if val, ok := extras["Extensions"]; ok {
-		//do something here
-		plan.Extensions = val.ValueInt
-	}
-	if val, ok := extras["Fax"]; ok {
-		//do something here
-		plan.Fax = val.ValueInt
-	}
-	if val, ok := extras["Porting"]; ok {
-		//do something here
-		plan.Porting = val.ValueBool
-	}
-	if val, ok := extras["CallingBetweenExt"]; ok {
-		//do something here
-		plan.CallingBetweenExt = val.ValueBool
-	}
-	if val, ok := extras["StandardCallFeat"]; ok {
-		//do something here
-		plan.StandardCallFeat = val.ValueBool
-	}
-	if val, ok := extras["VoicemailTranscriptions"]; ok {
-		//do something here
-		plan.VoicemailTranscriptions = val.ValueBool
-	}
-	if val, ok := extras["ImIntegrations"]; ok {
-		//do something here
-		plan.ImIntegrations = val.ValueBool
-	}
-	if val, ok := extras["ProductivityIntegrations"]; ok {
-		//do something here
-		plan.ProductivityIntegrations = val.ValueBool
-	}
-	if val, ok := extras["VoiceAnalytics"]; ok {
-		//do something here
-		plan.VoiceAnalytics = val.ValueBool
-	}
-	if val, ok := extras["FraudProtection"]; ok {
-		//do something here
-		plan.FraudProtection = val.ValueBool
-	}
-
-	if val, ok := extras["CrmIntegrations"]; ok {
-		//do something here
-		plan.CrmIntegrations = val.ValueBool
-	}
-	if val, ok := extras["Sso"]; ok {
-		//do something here
-		plan.Sso = val.ValueBool
-	}
-	if val, ok := extras["ProgrammableToolkit"]; ok {
-		//do something here
-		plan.Sso = val.ValueBool
-	}
-	if val, ok := extras["Provisioner"]; ok {
-		//do something here
-		plan.Provisioner = val.ValueBool
-	}
-	if val, ok := extras["Vpn"]; ok {
-		//do something here
-		plan.Vpn = val.ValueBool
-	}
-	if val, ok := extras["MultipleSipDomains"]; ok {
-		//do something here
-		plan.MultipleSipDomains = val.ValueBool
-	}
-	if val, ok := extras["BringCarrier"]; ok {
-		//do something here
-		plan.BringCarrier = val.ValueBool
-	}
-	if val, ok := extras["CallCenter"]; ok {
-		//do something here
-		plan.CallCenter = val.ValueBool
-	}
-	if val, ok := extras["247Support"]; ok {
-		//do something here
-		plan.Config247Support = val.ValueBool
-	}
-	if val, ok := extras["AiCalls"]; ok {
-		//do something here
-		plan.AiCalls = val.ValueBool
-	}
-	return plan
-}
 
 func UpdateLiveStat(server *MediaServer, stat string, value string) error {
-	db, err := CreateDBConn()
-	if err != nil {
-		fmt.Printf("could not create DB..")
-		fmt.Println(err)
-		return err
-	}
-
-	stmt, err := db.Prepare("UPDATE media_servers SET " + stat + " = ? WHERE id = ?")
-
-	if err != nil {
-		fmt.Printf("could not prepare query..")
-		return err
-	}
-
-	defer stmt.Close()
-	_, err = stmt.Exec(value, strconv.Itoa(server.Id))
-	if err != nil {
-		fmt.Printf("could not execute query..")
-		fmt.Println(err)
-		return err
-	}
-	return nil
+	return updateLiveStatNow(MemberKindMediaServer, server.Id, stat, value)
 }
 
 func UpdateRouterLiveStat(router *SIPRouter, stat string, value string) error {
-	db, err := CreateDBConn()
-	if err != nil {
-		fmt.Printf("could not create DB..")
-		fmt.Println(err)
-		return err
-	}
-
-	stmt, err := db.Prepare("UPDATE sip_routers SET " + stat + " = ? WHERE id = ?")
-
-	if err != nil {
-		fmt.Printf("could not prepare query..")
-		return err
-	}
-
-	defer stmt.Close()
-	_, err = stmt.Exec(value, strconv.Itoa(router.Id))
-	if err != nil {
-		fmt.Printf("could not execute query..")
-		fmt.Println(err)
-		return err
-	}
-	return nil
+	return updateLiveStatNow(MemberKindSIPRouter, router.Id, stat, value)
 }
 
 func GenerateDeduplicationKey(source string, year int, month int, day int, workspaceId int, didId int) string {
@@ -2097,7 +1775,7 @@ func GetSubscription(workspaceId int) (*Subscription, error) {
 
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, errors.New("subscription not found")
+			return nil, ErrSubscriptionNotFound
 		}
 		fmt.Printf("could not query subscription: %v\n", err)
 		return nil, err
@@ -2113,6 +1791,15 @@ func GetSubscription(workspaceId int) (*Subscription, error) {
 	if providerSubscriptionId.Valid {
 		sub.ProviderSubscriptionId = &providerSubscriptionId.String
 	}
+	if billingAnchorDay.Valid {
+		sub.BillingAnchorDay = int(billingAnchorDay.Int64)
+	}
+	if freeTrialStartDate.Valid {
+		sub.FreeTrialStartDate = &freeTrialStartDate.Time
+	}
+	if freeTrialEndDate.Valid {
+		sub.FreeTrialEndDate = &freeTrialEndDate.Time
+	}
 
 	return sub, nil
 }
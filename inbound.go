@@ -0,0 +1,132 @@
+package helpers
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const (
+	InboundAllowed           = "allowed"
+	InboundUnknownDID        = "unknown_did"
+	InboundWorkspaceNotFound = "workspace_not_found"
+	InboundSuspended         = "workspace_suspended"
+	InboundBYODisabled       = "byo_disabled"
+	InboundIPNotWhitelisted  = "ip_not_whitelisted"
+	InboundCallerBlocked     = "caller_blocked"
+)
+
+// InboundDecision is the outcome of AuthorizeInbound. Reason says why a call was
+// rejected, or InboundAllowed.
+type InboundDecision struct {
+	Allowed   bool       `json:"allowed"`
+	Reason    string     `json:"reason"`
+	Source    string     `json:"source"`
+	Rule      *IPRule    `json:"rule"`
+	BlockRule *BlockRule `json:"block_rule"`
+	Workspace *Workspace `json:"workspace"`
+}
+
+func (d *InboundDecision) deny(reason string) *InboundDecision {
+	d.Allowed = false
+	d.Reason = reason
+	return d
+}
+
+// resolveInboundDID finds the workspace owning did and whether it's a BYO number,
+// sql.ErrNoRows when neither kind of number matches
+func resolveInboundDID(did string) (int, string, error) {
+	workspaceId, err := getWorkspaceIdForDID(IPRuleSourceProvider, did)
+	if err != nil {
+		return 0, "", err
+	}
+	if workspaceId != 0 {
+		return workspaceId, IPRuleSourceProvider, nil
+	}
+	workspaceId, err = getWorkspaceIdForDID(IPRuleSourceBYO, did)
+	if err != nil {
+		return 0, "", err
+	}
+	if workspaceId == 0 {
+		return 0, "", sql.ErrNoRows
+	}
+	return workspaceId, IPRuleSourceBYO, nil
+}
+
+// AuthorizeInbound decides whether a call from sourceIp and caller from may reach did.
+// checks run in order: number ownership, suspension, BYO, IP whitelist, blocked callers.
+// an error is only returned when a check could not be run.
+func AuthorizeInbound(did string, sourceIp string, from string) (*InboundDecision, error) {
+	decision := &InboundDecision{}
+	workspaceId, source, err := resolveInboundDID(did)
+	if err == sql.ErrNoRows {
+		return decision.deny(InboundUnknownDID), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	decision.Source = source
+
+	workspace, err := GetWorkspaceFromDB(workspaceId)
+	if err == sql.ErrNoRows {
+		return decision.deny(InboundWorkspaceNotFound), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// GetWorkspaceFromDB doesn't load the inbound flags
+	err = db.QueryRow("SELECT byo_enabled, ip_whitelist_disabled FROM workspaces WHERE id = ?", workspace.Id).Scan(&workspace.BYOEnabled, &workspace.IPWhitelistDisabled)
+	if err != nil {
+		return nil, err
+	}
+	decision.Workspace = workspace
+
+	status, err := GetSuspensionStatus(workspace.Id, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if status.State == SuspensionStateSuspended {
+		return decision.deny(InboundSuspended), nil
+	}
+
+	if source == IPRuleSourceBYO && !workspace.BYOEnabled {
+		return decision.deny(InboundBYODisabled), nil
+	}
+
+	if !workspace.IPWhitelistDisabled {
+		list, err := GetIPWhitelist(source, workspace.Id)
+		if err != nil {
+			return nil, err
+		}
+		rule, ok := list.Match(sourceIp)
+		if !ok {
+			return decision.deny(InboundIPNotWhitelisted), nil
+		}
+		decision.Rule = rule
+	}
+
+	blockRule, blocked, err := MatchBlocklist(workspace.Id, from, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	decision.BlockRule = blockRule
+	if blocked {
+		return decision.deny(InboundCallerBlocked), nil
+	}
+
+	decision.Allowed = true
+	decision.Reason = InboundAllowed
+	return decision, nil
+}
+
+// LogInboundDecision prints why a call was rejected
+func LogInboundDecision(did string, sourceIp string, from string, decision *InboundDecision) {
+	if decision.Allowed {
+		return
+	}
+	workspaceId := 0
+	if decision.Workspace != nil {
+		workspaceId = decision.Workspace.Id
+	}
+	fmt.Printf("rejected inbound call to %s from %s (%s), workspace %d: %s\r\n", did, from, sourceIp, workspaceId, decision.Reason)
+}
@@ -0,0 +1,356 @@
+package helpers
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	IPRuleSourceProvider = "provider"
+	IPRuleSourceBYO      = "byo"
+)
+
+const ipWhitelistChannel = "ip_whitelist_changed"
+
+const defaultIPWhitelistTTL = 5 * time.Minute
+
+// IPRule is a whitelist entry, returned on a match so callers can log what allowed a call
+type IPRule struct {
+	Source      string     `json:"source"`
+	OwnerId     int        `json:"owner_id"`
+	WorkspaceId int        `json:"workspace_id"`
+	Cidr        string     `json:"cidr"`
+	Network     *net.IPNet `json:"-"`
+}
+
+type ipTrieNode struct {
+	children [2]*ipTrieNode
+	rule     *IPRule
+}
+
+// IPWhitelist is a binary prefix trie per address family, lookups cost one step per bit
+type IPWhitelist struct {
+	v4   *ipTrieNode
+	v6   *ipTrieNode
+	Size int
+}
+
+func NewIPWhitelist() *IPWhitelist {
+	return &IPWhitelist{v4: &ipTrieNode{}, v6: &ipTrieNode{}}
+}
+
+// ParseIPNetwork accepts a CIDR or a bare IPv4/IPv6 address, bare addresses are
+// treated as a single host
+func ParseIPNetwork(value string) (*net.IPNet, error) {
+	value = strings.TrimSpace(value)
+	if strings.Contains(value, "/") {
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		return normalizeIPNet(network), nil
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip address %s", value)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+func normalizeIPNet(network *net.IPNet) *net.IPNet {
+	ones, bits := network.Mask.Size()
+	if ip4 := network.IP.To4(); ip4 != nil && bits == 128 && ones >= 96 {
+		// IPv4 mapped IPv6 ranges go in the IPv4 trie
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(ones-96, 32)}
+	}
+	return network
+}
+
+func (w *IPWhitelist) root(ip net.IP) (*ipTrieNode, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return w.v4, ip4
+	}
+	return w.v6, ip.To16()
+}
+
+func ipBit(ip net.IP, i int) int {
+	return int(ip[i/8]>>(7-uint(i%8))) & 1
+}
+
+func (w *IPWhitelist) Insert(cidr string, rule *IPRule) error {
+	network, err := ParseIPNetwork(cidr)
+	if err != nil {
+		return err
+	}
+	rule.Network = network
+	if rule.Cidr == "" {
+		rule.Cidr = network.String()
+	}
+	node, ip := w.root(network.IP)
+	ones, _ := network.Mask.Size()
+	for i := 0; i < ones; i++ {
+		bit := ipBit(ip, i)
+		if node.children[bit] == nil {
+			node.children[bit] = &ipTrieNode{}
+		}
+		node = node.children[bit]
+	}
+	if node.rule == nil {
+		w.Size++
+	}
+	node.rule = rule
+	return nil
+}
+
+// Match returns the most specific rule containing ip
+func (w *IPWhitelist) Match(sourceIp string) (*IPRule, bool) {
+	ip := net.ParseIP(strings.TrimSpace(sourceIp))
+	if ip == nil {
+		return nil, false
+	}
+	node, ip := w.root(ip)
+	var match *IPRule
+	for i := 0; node != nil; i++ {
+		if node.rule != nil {
+			match = node.rule
+		}
+		if i == len(ip)*8 {
+			break
+		}
+		node = node.children[ipBit(ip, i)]
+	}
+	return match, match != nil
+}
+
+type cachedIPWhitelist struct {
+	list     *IPWhitelist
+	loadedAt time.Time
+}
+
+type cachedDIDWorkspace struct {
+	// workspaceId is 0 for numbers that aren't assigned
+	workspaceId int
+	loadedAt    time.Time
+}
+
+var ipWhitelistCache = struct {
+	sync.RWMutex
+	lists map[string]*cachedIPWhitelist
+	dids  map[string]*cachedDIDWorkspace
+}{lists: make(map[string]*cachedIPWhitelist), dids: make(map[string]*cachedDIDWorkspace)}
+
+// published instead of a workspace id when a number's assignment changes
+const didInvalidationPrefix = "did:"
+
+func ipWhitelistKey(source string, workspaceId int) string {
+	return source + ":" + strconv.Itoa(workspaceId)
+}
+
+func didWorkspaceKey(source string, did string) string {
+	return source + ":" + did
+}
+
+func getIPWhitelistTTL() time.Duration {
+	if val := os.Getenv("IP_WHITELIST_TTL_SECONDS"); val != "" {
+		seconds, err := strconv.Atoi(val)
+		if err == nil {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return defaultIPWhitelistTTL
+}
+
+func loadIPWhitelist(source string, workspaceId int) (*IPWhitelist, error) {
+	var query string
+	switch source {
+	case IPRuleSourceProvider:
+		query = `SELECT sip_providers_whitelist_ips.provider_id, sip_providers_whitelist_ips.ip_address, sip_providers_whitelist_ips.ip_address_range
+		FROM sip_providers_whitelist_ips
+		INNER JOIN sip_providers ON sip_providers.id = sip_providers_whitelist_ips.provider_id
+		WHERE sip_providers_whitelist_ips.workspace_id = ?`
+	case IPRuleSourceBYO:
+		query = `SELECT byo_carriers_ips.carrier_id, byo_carriers_ips.ip, byo_carriers_ips.range
+		FROM byo_carriers_ips
+		INNER JOIN byo_carriers ON byo_carriers.id = byo_carriers_ips.carrier_id
+		WHERE byo_carriers.workspace_id = ?`
+	default:
+		return nil, fmt.Errorf("unknown ip whitelist source %s", source)
+	}
+	results, err := db.Query(query, workspaceId)
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	list := NewIPWhitelist()
+	for results.Next() {
+		var ownerId int
+		var ipAddr string
+		var ipAddrRange sql.NullString
+		err = results.Scan(&ownerId, &ipAddr, &ipAddrRange)
+		if err != nil {
+			return nil, err
+		}
+		fullIp := ipAddr + ipAddrRange.String
+		err = list.Insert(fullIp, &IPRule{Source: source, OwnerId: ownerId, WorkspaceId: workspaceId, Cidr: fullIp})
+		if err != nil {
+			fmt.Printf("skipping invalid whitelist entry %s for workspace %d: %v\r\n", fullIp, workspaceId, err)
+		}
+	}
+	return list, results.Err()
+}
+
+// GetIPWhitelist returns the workspace's whitelist for source, loading it from MySQL
+// when it isn't cached or the cached copy is older than the TTL
+func GetIPWhitelist(source string, workspaceId int) (*IPWhitelist, error) {
+	key := ipWhitelistKey(source, workspaceId)
+	ipWhitelistCache.RLock()
+	cached, ok := ipWhitelistCache.lists[key]
+	ipWhitelistCache.RUnlock()
+	if ok && time.Since(cached.loadedAt) < getIPWhitelistTTL() {
+		return cached.list, nil
+	}
+	list, err := loadIPWhitelist(source, workspaceId)
+	if err != nil {
+		return nil, err
+	}
+	ipWhitelistCache.Lock()
+	ipWhitelistCache.lists[key] = &cachedIPWhitelist{list: list, loadedAt: time.Now()}
+	ipWhitelistCache.Unlock()
+	return list, nil
+}
+
+func dropIPWhitelists(workspaceId int) {
+	ipWhitelistCache.Lock()
+	delete(ipWhitelistCache.lists, ipWhitelistKey(IPRuleSourceProvider, workspaceId))
+	delete(ipWhitelistCache.lists, ipWhitelistKey(IPRuleSourceBYO, workspaceId))
+	for key, cached := range ipWhitelistCache.dids {
+		if cached.workspaceId == workspaceId {
+			delete(ipWhitelistCache.dids, key)
+		}
+	}
+	ipWhitelistCache.Unlock()
+}
+
+func dropDIDWorkspace(key string) {
+	ipWhitelistCache.Lock()
+	delete(ipWhitelistCache.dids, key)
+	ipWhitelistCache.Unlock()
+}
+
+// InvalidateIPWhitelists should be called after a workspace's whitelist changes. other
+// processes running StartIPWhitelistSync drop their copy too.
+func InvalidateIPWhitelists(workspaceId int) error {
+	dropIPWhitelists(workspaceId)
+	rdb, err := CreateRedisConn()
+	if err != nil {
+		return err
+	}
+	return rdb.Publish(ipWhitelistChannel, strconv.Itoa(workspaceId)).Err()
+}
+
+// InvalidateDIDWorkspace should be called after a number is assigned, moved or released
+// so whitelist matching stops using the cached workspace for it
+func InvalidateDIDWorkspace(source string, did string) error {
+	key := didWorkspaceKey(source, did)
+	dropDIDWorkspace(key)
+	rdb, err := CreateRedisConn()
+	if err != nil {
+		return err
+	}
+	return rdb.Publish(ipWhitelistChannel, didInvalidationPrefix+key).Err()
+}
+
+// StartIPWhitelistSync listens for whitelist changes published by other processes
+func StartIPWhitelistSync() error {
+	rdb, err := CreateRedisConn()
+	if err != nil {
+		return err
+	}
+	pubsub := rdb.Subscribe(ipWhitelistChannel)
+	_, err = pubsub.Receive()
+	if err != nil {
+		return err
+	}
+	go func() {
+		for msg := range pubsub.Channel() {
+			if strings.HasPrefix(msg.Payload, didInvalidationPrefix) {
+				dropDIDWorkspace(strings.TrimPrefix(msg.Payload, didInvalidationPrefix))
+				continue
+			}
+			workspaceId, err := strconv.Atoi(msg.Payload)
+			if err != nil {
+				continue
+			}
+			dropIPWhitelists(workspaceId)
+		}
+	}()
+	return nil
+}
+
+func loadWorkspaceIdForDID(source string, did string) (int, error) {
+	var query string
+	if source == IPRuleSourceBYO {
+		query = "SELECT workspace_id FROM byo_did_numbers WHERE number = ?"
+	} else {
+		query = "SELECT workspace_id FROM did_numbers WHERE api_number = ?"
+	}
+	var workspaceId int
+	err := db.QueryRow(query, did).Scan(&workspaceId)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return workspaceId, nil
+}
+
+// getWorkspaceIdForDID returns the workspace a number is assigned to, 0 when it isn't.
+// lookups are cached with the whitelists and dropped with them.
+func getWorkspaceIdForDID(source string, did string) (int, error) {
+	key := didWorkspaceKey(source, did)
+	ipWhitelistCache.RLock()
+	cached, ok := ipWhitelistCache.dids[key]
+	ipWhitelistCache.RUnlock()
+	if ok && time.Since(cached.loadedAt) < getIPWhitelistTTL() {
+		return cached.workspaceId, nil
+	}
+	workspaceId, err := loadWorkspaceIdForDID(source, did)
+	if err != nil {
+		return 0, err
+	}
+	ipWhitelistCache.Lock()
+	ipWhitelistCache.dids[key] = &cachedDIDWorkspace{workspaceId: workspaceId, loadedAt: time.Now()}
+	ipWhitelistCache.Unlock()
+	return workspaceId, nil
+}
+
+// MatchIPWhitelist returns the rule allowing sourceIp to send calls to did, nil when none does
+func MatchIPWhitelist(source string, did string, sourceIp string) (*IPRule, error) {
+	workspaceId, err := getWorkspaceIdForDID(source, did)
+	if err != nil {
+		return nil, err
+	}
+	if workspaceId == 0 {
+		return nil, nil
+	}
+	list, err := GetIPWhitelist(source, workspaceId)
+	if err != nil {
+		return nil, err
+	}
+	rule, ok := list.Match(sourceIp)
+	if !ok {
+		return nil, nil
+	}
+	return rule, nil
+}
@@ -0,0 +1,75 @@
+package helpers
+
+import "testing"
+
+func TestIPWhitelistMatch(t *testing.T) {
+	w := NewIPWhitelist()
+	rules := []string{
+		"203.0.113.7",
+		"10.0.0.0/8",
+		"10.1.0.0/16",
+		"10.1.2.0/24",
+		"::ffff:192.168.0.0/112",
+		"2001:db8::/32",
+		"2001:db8:1::/48",
+		"2001:db8:1::5",
+	}
+	for _, cidr := range rules {
+		err := w.Insert(cidr, &IPRule{Cidr: cidr})
+		if err != nil {
+			t.Fatalf("could not insert %s: %v", cidr, err)
+		}
+	}
+	if w.Size != len(rules) {
+		t.Fatalf("expected %d rules, got %d", len(rules), w.Size)
+	}
+
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"single ip", "203.0.113.7", "203.0.113.7"},
+		{"next to a single ip", "203.0.113.8", ""},
+		{"cidr", "10.200.0.1", "10.0.0.0/8"},
+		{"most specific /16", "10.1.200.1", "10.1.0.0/16"},
+		{"most specific /24", "10.1.2.3", "10.1.2.0/24"},
+		{"outside every range", "11.0.0.1", ""},
+		{"ipv4 mapped rule matches an ipv4 source", "192.168.4.5", "::ffff:192.168.0.0/112"},
+		{"ipv4 mapped source matches an ipv4 rule", "::ffff:10.1.2.3", "10.1.2.0/24"},
+		{"ipv6 cidr", "2001:db8:ffff::1", "2001:db8::/32"},
+		{"most specific ipv6 cidr", "2001:db8:1::1", "2001:db8:1::/48"},
+		{"ipv6 single address", "2001:db8:1::5", "2001:db8:1::5"},
+		{"ipv6 outside every range", "2001:db9::1", ""},
+		{"invalid source", "not-an-ip", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, ok := w.Match(tt.source)
+			if tt.want == "" {
+				if ok {
+					t.Fatalf("expected no match, got %s", rule.Cidr)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("expected %s to match %s", tt.source, tt.want)
+			}
+			if rule.Cidr != tt.want {
+				t.Fatalf("expected %s to match %s, got %s", tt.source, tt.want, rule.Cidr)
+			}
+		})
+	}
+}
+
+func TestIPWhitelistInsertInvalid(t *testing.T) {
+	w := NewIPWhitelist()
+	for _, cidr := range []string{"", "10.0.0.0/33", "300.1.1.1", "example.com"} {
+		if err := w.Insert(cidr, &IPRule{}); err == nil {
+			t.Fatalf("expected %q to be rejected", cidr)
+		}
+	}
+	if w.Size != 0 {
+		t.Fatalf("expected an empty whitelist, got %d rules", w.Size)
+	}
+}
@@ -0,0 +1,698 @@
+package helpers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	SubscriptionStatusTrialing = "trialing"
+	SubscriptionStatusActive   = "active"
+	SubscriptionStatusPastDue  = "past_due"
+	SubscriptionStatusCanceled = "canceled"
+)
+
+const (
+	SubscriptionActionStartTrial        = "start_trial"
+	SubscriptionActionConvertTrial      = "convert_trial"
+	SubscriptionActionUpgrade           = "upgrade"
+	SubscriptionActionScheduleDowngrade = "schedule_downgrade"
+	SubscriptionActionCancel            = "cancel_at_period_end"
+	SubscriptionActionReactivate        = "reactivate"
+	SubscriptionActionApplyScheduled    = "apply_scheduled"
+	SubscriptionActionExpire            = "expire"
+	SubscriptionActionProviderSync      = "provider_sync"
+)
+
+// statuses each action may start from, and the status it ends in
+var subscriptionTransitions = map[string]struct {
+	From []string
+	To   string
+}{
+	SubscriptionActionStartTrial:        {From: []string{""}, To: SubscriptionStatusTrialing},
+	SubscriptionActionConvertTrial:      {From: []string{SubscriptionStatusTrialing}, To: SubscriptionStatusActive},
+	SubscriptionActionUpgrade:           {From: []string{SubscriptionStatusActive}, To: SubscriptionStatusActive},
+	SubscriptionActionScheduleDowngrade: {From: []string{SubscriptionStatusActive}, To: SubscriptionStatusActive},
+	SubscriptionActionCancel:            {From: []string{SubscriptionStatusActive, SubscriptionStatusTrialing, SubscriptionStatusPastDue}, To: ""},
+	SubscriptionActionReactivate:        {From: []string{SubscriptionStatusActive, SubscriptionStatusTrialing, SubscriptionStatusCanceled}, To: SubscriptionStatusActive},
+	SubscriptionActionApplyScheduled:    {From: []string{SubscriptionStatusActive, SubscriptionStatusPastDue}, To: ""},
+	SubscriptionActionExpire:            {From: []string{SubscriptionStatusActive, SubscriptionStatusTrialing, SubscriptionStatusPastDue}, To: SubscriptionStatusCanceled},
+}
+
+type InvalidTransitionError struct {
+	Action string
+	Status string
+}
+
+func (e *InvalidTransitionError) Error() string {
+	return fmt.Sprintf("cannot %s a subscription that is %s", e.Action, e.Status)
+}
+
+type SubscriptionTransition struct {
+	SubscriptionId int
+	WorkspaceId    int
+	Action         string
+	FromStatus     string
+	ToStatus       string
+	FromPlanId     int
+	ToPlanId       int
+	CreatedAt      time.Time
+}
+
+// validateTransition returns the status the subscription moves to, an empty To keeps the current status
+func validateTransition(sub *Subscription, action string) (string, error) {
+	transition, ok := subscriptionTransitions[action]
+	if !ok {
+		return "", fmt.Errorf("unknown subscription action %s", action)
+	}
+	status := ""
+	if sub != nil {
+		status = sub.Status
+	}
+	for _, from := range transition.From {
+		if from == status {
+			if transition.To == "" {
+				return status, nil
+			}
+			return transition.To, nil
+		}
+	}
+	return "", &InvalidTransitionError{Action: action, Status: status}
+}
+
+func recordSubscriptionTransition(transition *SubscriptionTransition) error {
+	_, err := db.Exec("INSERT INTO subscription_transitions (`subscription_id`, `workspace_id`, `action`, `from_status`, `to_status`, `from_plan_id`, `to_plan_id`, `created_at`) VALUES ( ?, ?, ?, ?, ?, ?, ?, ? )",
+		transition.SubscriptionId, transition.WorkspaceId, transition.Action, transition.FromStatus, transition.ToStatus, transition.FromPlanId, transition.ToPlanId, transition.CreatedAt)
+	return err
+}
+
+func GetSubscriptionTransitions(workspaceId int) ([]SubscriptionTransition, error) {
+	results, err := db.Query("SELECT subscription_id, workspace_id, action, from_status, to_status, from_plan_id, to_plan_id, created_at FROM subscription_transitions WHERE workspace_id = ? ORDER BY created_at", workspaceId)
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+	transitions := make([]SubscriptionTransition, 0)
+	for results.Next() {
+		value := SubscriptionTransition{}
+		err = results.Scan(&value.SubscriptionId, &value.WorkspaceId, &value.Action, &value.FromStatus, &value.ToStatus, &value.FromPlanId, &value.ToPlanId, &value.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		transitions = append(transitions, value)
+	}
+	return transitions, results.Err()
+}
+
+// PendingPlanChange is a change the payer still has to approve with the provider,
+// e.g. a paypal subscription or revision. nothing is switched or charged until
+// ConfirmPendingPlanChange runs for it.
+type PendingPlanChange struct {
+	Id                     int       `json:"id"`
+	SubscriptionId         int       `json:"subscription_id"`
+	WorkspaceId            int       `json:"workspace_id"`
+	Action                 string    `json:"action"`
+	PlanId                 int       `json:"plan_id"`
+	BillingCycle           string    `json:"billing_cycle"`
+	ProviderSubscriptionId string    `json:"provider_subscription_id"`
+	ProviderPlanId         string    `json:"provider_plan_id"`
+	ProrationCents         int       `json:"proration_cents"`
+	ApprovalUrl            string    `json:"approval_url"`
+	CreatedAt              time.Time `json:"created_at"`
+}
+
+// savePendingPlanChange keeps one pending change per subscription, a newer one replaces it
+func savePendingPlanChange(change *PendingPlanChange) error {
+	_, err := db.Exec(`INSERT INTO subscription_pending_changes (`+"`subscription_id`, `workspace_id`, `action`, `plan_id`, `billing_cycle`, `provider_subscription_id`, `provider_plan_id`, `proration_cents`, `approval_url`, `created_at`"+`) VALUES ( ?, ?, ?, ?, ?, ?, ?, ?, ?, ? )
+		ON DUPLICATE KEY UPDATE action = VALUES(action), plan_id = VALUES(plan_id), billing_cycle = VALUES(billing_cycle), provider_subscription_id = VALUES(provider_subscription_id),
+		provider_plan_id = VALUES(provider_plan_id), proration_cents = VALUES(proration_cents), approval_url = VALUES(approval_url), created_at = VALUES(created_at)`,
+		change.SubscriptionId, change.WorkspaceId, change.Action, change.PlanId, change.BillingCycle, change.ProviderSubscriptionId, change.ProviderPlanId, change.ProrationCents, change.ApprovalUrl, change.CreatedAt)
+	return err
+}
+
+const pendingPlanChangeColumns = "id, subscription_id, workspace_id, action, plan_id, billing_cycle, provider_subscription_id, provider_plan_id, proration_cents, approval_url, created_at"
+
+func scanPendingPlanChange(row interface{ Scan(...interface{}) error }) (*PendingPlanChange, error) {
+	change := &PendingPlanChange{}
+	err := row.Scan(&change.Id, &change.SubscriptionId, &change.WorkspaceId, &change.Action, &change.PlanId, &change.BillingCycle,
+		&change.ProviderSubscriptionId, &change.ProviderPlanId, &change.ProrationCents, &change.ApprovalUrl, &change.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return change, nil
+}
+
+// GetPendingPlanChange returns the change waiting on approval, or nil when there is none
+func GetPendingPlanChange(workspaceId int) (*PendingPlanChange, error) {
+	row := db.QueryRow("SELECT "+pendingPlanChangeColumns+" FROM subscription_pending_changes WHERE workspace_id = ?", workspaceId)
+	change, err := scanPendingPlanChange(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return change, err
+}
+
+// ConfirmPendingPlanChange applies the change waiting on providerSubscriptionId once the
+// provider reports it approved with providerPlanId. it does nothing when no change is
+// waiting, so repeated webhooks are safe.
+func ConfirmPendingPlanChange(providerSubscriptionId string, providerPlanId string, now time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	row := tx.QueryRow("SELECT "+pendingPlanChangeColumns+" FROM subscription_pending_changes WHERE provider_subscription_id = ? AND provider_plan_id = ? FOR UPDATE",
+		providerSubscriptionId, providerPlanId)
+	change, err := scanPendingPlanChange(row)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return nil
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM subscription_pending_changes WHERE id = ?", change.Id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	sub, err := GetSubscription(change.WorkspaceId)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	toStatus, err := validateTransition(sub, change.Action)
+	if err != nil {
+		// e.g. canceled while waiting on the approval, drop the change
+		fmt.Printf("dropping pending %s for workspace %d: %v\r\n", change.Action, change.WorkspaceId, err)
+		return tx.Commit()
+	}
+	switch change.Action {
+	case SubscriptionActionConvertTrial:
+		var plan *ServicePlan
+		plan, err = GetServicePlan(change.PlanId)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		_, err = tx.Exec("UPDATE subscriptions SET status = ?, billing_cycle = ?, current_period_end = ?, provider_subscription_id = ?, is_free_trial_active = 0, free_trial_end_date = ?, updated_at = ? WHERE id = ?",
+			toStatus, change.BillingCycle, addBillingCycle(now, change.BillingCycle), change.ProviderSubscriptionId, convertedTrialEnd(sub, plan, now), now, sub.Id)
+	default:
+		_, err = tx.Exec("UPDATE subscriptions SET current_plan_id = ?, scheduled_plan_id = NULL, scheduled_effective_date = NULL, updated_at = ? WHERE id = ?", change.PlanId, now, sub.Id)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	err = recordSubscriptionTransition(&SubscriptionTransition{SubscriptionId: sub.Id, WorkspaceId: sub.WorkspaceId, Action: change.Action, FromStatus: sub.Status, ToStatus: toStatus, FromPlanId: sub.CurrentPlanId, ToPlanId: change.PlanId, CreatedAt: now})
+	if err != nil {
+		return err
+	}
+	if change.Action != SubscriptionActionUpgrade || change.ProrationCents <= 0 {
+		return nil
+	}
+	return chargePendingUpgrade(sub, change)
+}
+
+// chargePendingUpgrade bills the proration of an upgrade that was approved after the
+// fact. the plan has already switched at the provider, so a failed charge goes to dunning.
+func chargePendingUpgrade(sub *Subscription, change *PendingPlanChange) error {
+	oldPlan, err := GetServicePlan(sub.CurrentPlanId)
+	if err != nil {
+		return err
+	}
+	newPlan, err := GetServicePlan(change.PlanId)
+	if err != nil {
+		return err
+	}
+	user, workspace, err := getSubscriptionOwner(sub.WorkspaceId)
+	if err != nil {
+		return err
+	}
+	provider, err := GetPaymentProvider(workspace)
+	if err != nil {
+		return err
+	}
+	result, err := chargeUpgrade(provider, user, workspace, sub, oldPlan, newPlan, change.ProrationCents)
+	if err != nil {
+		return err
+	}
+	if result.Status != PaymentSucceeded {
+		return OnPaymentFailed(sub.WorkspaceId, time.Now())
+	}
+	return nil
+}
+
+func chargeUpgrade(provider PaymentProvider, user *User, workspace *Workspace, sub *Subscription, oldPlan *ServicePlan, newPlan *ServicePlan, cents int) (*PaymentResult, error) {
+	return provider.Charge(user, workspace, &ChargeReq{
+		Cents:          cents,
+		Description:    fmt.Sprintf("Upgrade from %s to %s", oldPlan.NiceName, newPlan.NiceName),
+		IdempotencyKey: CreatePaymentIdempotencyKey(workspace.Id, "upgrade", fmt.Sprintf("%d_%d_%d", oldPlan.Id, newPlan.Id, sub.CurrentPeriodEnd.Unix())),
+	})
+}
+
+func addBillingCycle(start time.Time, cycle string) time.Time {
+	if cycle == BillingCycleAnnual {
+		return addMonths(start, 12)
+	}
+	return addMonths(start, 1)
+}
+
+func planPriceCents(plan *ServicePlan, cycle string) int {
+	if cycle == BillingCycleAnnual {
+		return plan.AnnualCostCents
+	}
+	return plan.MonthlyCostCents
+}
+
+// subscriptionAttempt identifies one attempt at creating a provider subscription for
+// sub. it changes whenever the row is updated, so a later resubscribe gets a new
+// idempotency key while a retry of a failed attempt reuses the old one.
+func subscriptionAttempt(sub *Subscription, action string) string {
+	return fmt.Sprintf("%s_%d_%d", action, sub.Id, sub.UpdatedAt.Unix())
+}
+
+func getSubscriptionOwner(workspaceId int) (*User, *Workspace, error) {
+	workspace, err := GetWorkspaceFromDB(workspaceId)
+	if err != nil {
+		return nil, nil, err
+	}
+	user, err := GetUserFromDB(workspace.CreatorId)
+	if err != nil {
+		return nil, nil, err
+	}
+	return user, workspace, nil
+}
+
+// StartTrial creates a trialing subscription for a workspace that has none
+func StartTrial(workspaceId int, plan *ServicePlan, trialDays int, now time.Time) (*Subscription, error) {
+	existing, err := GetSubscription(workspaceId)
+	if err != nil && err != ErrSubscriptionNotFound {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, &InvalidTransitionError{Action: SubscriptionActionStartTrial, Status: existing.Status}
+	}
+	toStatus, err := validateTransition(nil, SubscriptionActionStartTrial)
+	if err != nil {
+		return nil, err
+	}
+
+	trialEnd := now.AddDate(0, 0, trialDays)
+	res, err := db.Exec("INSERT INTO subscriptions (`workspace_id`, `current_plan_id`, `billing_cycle`, `status`, `current_period_end`, `is_free_trial_active`, `free_trial_start_date`, `free_trial_end_date`, `created_at`, `updated_at`) VALUES ( ?, ?, ?, ?, ?, 1, ?, ?, ?, ? )",
+		workspaceId, plan.Id, BillingCycleMonthly, toStatus, trialEnd, now, trialEnd, now, now)
+	if err != nil {
+		return nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	err = recordSubscriptionTransition(&SubscriptionTransition{SubscriptionId: int(id), WorkspaceId: workspaceId, Action: SubscriptionActionStartTrial, ToStatus: toStatus, ToPlanId: plan.Id, CreatedAt: now})
+	if err != nil {
+		return nil, err
+	}
+	return GetSubscription(workspaceId)
+}
+
+// convertedTrialEnd is the trial end date to store when a trial converts. plans that
+// end the trial on purchase end it now, others keep the original end date.
+func convertedTrialEnd(sub *Subscription, plan *ServicePlan, now time.Time) *time.Time {
+	if plan.TrialEndsOnPurchase {
+		return &now
+	}
+	return sub.FreeTrialEndDate
+}
+
+// ConvertTrial starts a paid subscription with the payment provider. the trial ends
+// now on plans with TrialEndsOnPurchase and runs to its end date otherwise.
+// when the returned subscription has an ApprovalUrl the trial only ends once
+// ConfirmPendingPlanChange runs for it.
+func ConvertTrial(workspaceId int, cycle string, now time.Time) (*ProviderSubscription, error) {
+	sub, err := GetSubscription(workspaceId)
+	if err != nil {
+		return nil, err
+	}
+	toStatus, err := validateTransition(sub, SubscriptionActionConvertTrial)
+	if err != nil {
+		return nil, err
+	}
+	plan, err := GetServicePlan(sub.CurrentPlanId)
+	if err != nil {
+		return nil, err
+	}
+	user, workspace, err := getSubscriptionOwner(workspaceId)
+	if err != nil {
+		return nil, err
+	}
+	provider, err := GetPaymentProvider(workspace)
+	if err != nil {
+		return nil, err
+	}
+	providerSub, err := provider.CreateSubscription(user, workspace, plan, cycle, subscriptionAttempt(sub, SubscriptionActionConvertTrial))
+	if err != nil {
+		return nil, err
+	}
+	if providerSub.ApprovalUrl != "" {
+		// the trial keeps running until the provider confirms the approval
+		err = savePendingPlanChange(&PendingPlanChange{SubscriptionId: sub.Id, WorkspaceId: workspaceId, Action: SubscriptionActionConvertTrial, PlanId: plan.Id, BillingCycle: cycle,
+			ProviderSubscriptionId: providerSub.Id, ProviderPlanId: providerSub.PlanId, ApprovalUrl: providerSub.ApprovalUrl, CreatedAt: now})
+		if err != nil {
+			return nil, err
+		}
+		return providerSub, nil
+	}
+
+	_, err = db.Exec("UPDATE subscriptions SET status = ?, billing_cycle = ?, current_period_end = ?, provider_subscription_id = ?, is_free_trial_active = 0, free_trial_end_date = ?, updated_at = ? WHERE id = ?",
+		toStatus, cycle, addBillingCycle(now, cycle), providerSub.Id, convertedTrialEnd(sub, plan, now), now, sub.Id)
+	if err != nil {
+		return nil, err
+	}
+	err = recordSubscriptionTransition(&SubscriptionTransition{SubscriptionId: sub.Id, WorkspaceId: workspaceId, Action: SubscriptionActionConvertTrial, FromStatus: sub.Status, ToStatus: toStatus, FromPlanId: plan.Id, ToPlanId: plan.Id, CreatedAt: now})
+	if err != nil {
+		return nil, err
+	}
+	return providerSub, nil
+}
+
+// UpgradeSubscription moves to a more expensive plan immediately and charges the prorated difference.
+// when the provider needs the payer's approval it returns a requires_action result with the
+// ActionUrl, and the upgrade is finished by ConfirmPendingPlanChange.
+func UpgradeSubscription(workspaceId int, newPlan *ServicePlan, now time.Time) (*PaymentResult, error) {
+	sub, err := GetSubscription(workspaceId)
+	if err != nil {
+		return nil, err
+	}
+	toStatus, err := validateTransition(sub, SubscriptionActionUpgrade)
+	if err != nil {
+		return nil, err
+	}
+	oldPlan, err := GetServicePlan(sub.CurrentPlanId)
+	if err != nil {
+		return nil, err
+	}
+	if planPriceCents(newPlan, sub.BillingCycle) <= planPriceCents(oldPlan, sub.BillingCycle) {
+		return nil, errors.New("new plan is not an upgrade, schedule a downgrade instead")
+	}
+	user, workspace, err := getSubscriptionOwner(workspaceId)
+	if err != nil {
+		return nil, err
+	}
+	provider, err := GetPaymentProvider(workspace)
+	if err != nil {
+		return nil, err
+	}
+
+	proration, err := CalculateProration(&ProrationReq{Subscription: sub, OldPlan: oldPlan, NewPlan: newPlan, ChangeAt: now, Policy: ProrationImmediate})
+	if err != nil {
+		return nil, err
+	}
+	if sub.ProviderSubscriptionId != nil {
+		providerSub, err := provider.ChangeSubscription(sub, newPlan, sub.BillingCycle)
+		if err != nil {
+			return nil, err
+		}
+		if providerSub.ApprovalUrl != "" {
+			// the plan switches and the proration is charged once the provider confirms the approval
+			err = savePendingPlanChange(&PendingPlanChange{SubscriptionId: sub.Id, WorkspaceId: workspaceId, Action: SubscriptionActionUpgrade, PlanId: newPlan.Id, BillingCycle: sub.BillingCycle,
+				ProviderSubscriptionId: providerSub.Id, ProviderPlanId: providerSub.PlanId, ProrationCents: proration.NetCents, ApprovalUrl: providerSub.ApprovalUrl, CreatedAt: now})
+			if err != nil {
+				return nil, err
+			}
+			return &PaymentResult{Status: PaymentRequiresAction, ActionUrl: providerSub.ApprovalUrl}, nil
+		}
+	}
+	var result *PaymentResult
+	if proration.NetCents > 0 {
+		result, err = chargeUpgrade(provider, user, workspace, sub, oldPlan, newPlan, proration.NetCents)
+		if err != nil || result.Status != PaymentSucceeded {
+			revertProviderPlan(provider, sub, oldPlan)
+			return result, err
+		}
+	}
+
+	_, err = db.Exec("UPDATE subscriptions SET current_plan_id = ?, scheduled_plan_id = NULL, scheduled_effective_date = NULL, updated_at = ? WHERE id = ?", newPlan.Id, now, sub.Id)
+	if err != nil {
+		return result, err
+	}
+	err = recordSubscriptionTransition(&SubscriptionTransition{SubscriptionId: sub.Id, WorkspaceId: workspaceId, Action: SubscriptionActionUpgrade, FromStatus: sub.Status, ToStatus: toStatus, FromPlanId: oldPlan.Id, ToPlanId: newPlan.Id, CreatedAt: now})
+	return result, err
+}
+
+// revertProviderPlan moves the provider subscription back after the upgrade charge failed
+func revertProviderPlan(provider PaymentProvider, sub *Subscription, oldPlan *ServicePlan) {
+	if sub.ProviderSubscriptionId == nil {
+		return
+	}
+	_, err := provider.ChangeSubscription(sub, oldPlan, sub.BillingCycle)
+	if err != nil {
+		fmt.Printf("could not revert provider subscription for workspace %d to plan %s: %v\r\n", sub.WorkspaceId, oldPlan.KeyName, err)
+	}
+}
+
+// isPlanDowngrade tells whether newPlan is cheaper than oldPlan, or ranked lower at the same price
+func isPlanDowngrade(oldPlan *ServicePlan, newPlan *ServicePlan, cycle string) bool {
+	oldPrice := planPriceCents(oldPlan, cycle)
+	newPrice := planPriceCents(newPlan, cycle)
+	if newPrice != oldPrice {
+		return newPrice < oldPrice
+	}
+	return newPlan.Rank < oldPlan.Rank
+}
+
+// ScheduleDowngrade switches to newPlan when the current period ends
+func ScheduleDowngrade(workspaceId int, newPlan *ServicePlan, now time.Time) error {
+	sub, err := GetSubscription(workspaceId)
+	if err != nil {
+		return err
+	}
+	toStatus, err := validateTransition(sub, SubscriptionActionScheduleDowngrade)
+	if err != nil {
+		return err
+	}
+	oldPlan, err := GetServicePlan(sub.CurrentPlanId)
+	if err != nil {
+		return err
+	}
+	if !isPlanDowngrade(oldPlan, newPlan, sub.BillingCycle) {
+		return errors.New("new plan is not a downgrade, upgrade instead")
+	}
+	_, err = db.Exec("UPDATE subscriptions SET scheduled_plan_id = ?, scheduled_effective_date = ?, updated_at = ? WHERE id = ?", newPlan.Id, sub.CurrentPeriodEnd, now, sub.Id)
+	if err != nil {
+		return err
+	}
+	return recordSubscriptionTransition(&SubscriptionTransition{SubscriptionId: sub.Id, WorkspaceId: workspaceId, Action: SubscriptionActionScheduleDowngrade, FromStatus: sub.Status, ToStatus: toStatus, FromPlanId: sub.CurrentPlanId, ToPlanId: newPlan.Id, CreatedAt: now})
+}
+
+func CancelAtPeriodEnd(workspaceId int, now time.Time) error {
+	sub, err := GetSubscription(workspaceId)
+	if err != nil {
+		return err
+	}
+	toStatus, err := validateTransition(sub, SubscriptionActionCancel)
+	if err != nil {
+		return err
+	}
+	if sub.ProviderSubscriptionId != nil {
+		_, workspace, err := getSubscriptionOwner(workspaceId)
+		if err != nil {
+			return err
+		}
+		provider, err := GetPaymentProvider(workspace)
+		if err != nil {
+			return err
+		}
+		err = provider.CancelSubscription(sub, true)
+		if err == ErrCancelAtPeriodEndUnsupported {
+			// applyScheduledChange cancels it with the provider when the period ends
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err = db.Exec("UPDATE subscriptions SET cancel_at_period_end = 1, scheduled_plan_id = NULL, scheduled_effective_date = NULL, updated_at = ? WHERE id = ?", now, sub.Id)
+	if err != nil {
+		return err
+	}
+	return recordSubscriptionTransition(&SubscriptionTransition{SubscriptionId: sub.Id, WorkspaceId: workspaceId, Action: SubscriptionActionCancel, FromStatus: sub.Status, ToStatus: toStatus, FromPlanId: sub.CurrentPlanId, ToPlanId: sub.CurrentPlanId, CreatedAt: now})
+}
+
+// Reactivate undoes a pending cancellation, or starts a new provider subscription
+// on the previous plan when the subscription was already canceled
+func Reactivate(workspaceId int, now time.Time) (*ProviderSubscription, error) {
+	sub, err := GetSubscription(workspaceId)
+	if err != nil {
+		return nil, err
+	}
+	toStatus, err := validateTransition(sub, SubscriptionActionReactivate)
+	if err != nil {
+		return nil, err
+	}
+	if sub.Status != SubscriptionStatusCanceled && !sub.CancelAtPeriodEnd {
+		return nil, &InvalidTransitionError{Action: SubscriptionActionReactivate, Status: sub.Status}
+	}
+	user, workspace, err := getSubscriptionOwner(workspaceId)
+	if err != nil {
+		return nil, err
+	}
+	provider, err := GetPaymentProvider(workspace)
+	if err != nil {
+		return nil, err
+	}
+
+	var providerSub *ProviderSubscription
+	if sub.Status == SubscriptionStatusCanceled {
+		plan, err := GetServicePlan(sub.CurrentPlanId)
+		if err != nil {
+			return nil, err
+		}
+		providerSub, err = provider.CreateSubscription(user, workspace, plan, sub.BillingCycle, subscriptionAttempt(sub, SubscriptionActionReactivate))
+		if err != nil {
+			return nil, err
+		}
+		_, err = db.Exec("UPDATE subscriptions SET status = ?, cancel_at_period_end = 0, current_period_end = ?, provider_subscription_id = ?, updated_at = ? WHERE id = ?",
+			toStatus, addBillingCycle(now, sub.BillingCycle), providerSub.Id, now, sub.Id)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if sub.ProviderSubscriptionId != nil {
+			err = provider.ResumeSubscription(sub)
+			if err != nil {
+				return nil, err
+			}
+		}
+		toStatus = sub.Status
+		_, err = db.Exec("UPDATE subscriptions SET cancel_at_period_end = 0, updated_at = ? WHERE id = ?", now, sub.Id)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = recordSubscriptionTransition(&SubscriptionTransition{SubscriptionId: sub.Id, WorkspaceId: workspaceId, Action: SubscriptionActionReactivate, FromStatus: sub.Status, ToStatus: toStatus, FromPlanId: sub.CurrentPlanId, ToPlanId: sub.CurrentPlanId, CreatedAt: now})
+	return providerSub, err
+}
+
+// ApplyScheduledChanges activates scheduled plans and ends subscriptions that were
+// cancelled at period end. it's meant to run periodically and returns how many
+// subscriptions were changed.
+func ApplyScheduledChanges(now time.Time) (int, error) {
+	results, err := db.Query(`SELECT workspace_id FROM subscriptions
+		WHERE status <> ? AND (
+			(scheduled_plan_id IS NOT NULL AND scheduled_effective_date <= ?)
+			OR (cancel_at_period_end = 1 AND current_period_end <= ?))`, SubscriptionStatusCanceled, now, now)
+	if err != nil {
+		return 0, err
+	}
+	workspaceIds := make([]int, 0)
+	for results.Next() {
+		var id int
+		err = results.Scan(&id)
+		if err != nil {
+			results.Close()
+			return 0, err
+		}
+		workspaceIds = append(workspaceIds, id)
+	}
+	results.Close()
+
+	changed := 0
+	for _, workspaceId := range workspaceIds {
+		err = applyScheduledChange(workspaceId, now)
+		if err != nil {
+			fmt.Printf("could not apply scheduled change for workspace %d: %v\r\n", workspaceId, err)
+			continue
+		}
+		changed++
+	}
+	return changed, nil
+}
+
+func applyScheduledChange(workspaceId int, now time.Time) error {
+	sub, err := GetSubscription(workspaceId)
+	if err != nil {
+		return err
+	}
+	_, workspace, err := getSubscriptionOwner(workspaceId)
+	if err != nil {
+		return err
+	}
+	provider, err := GetPaymentProvider(workspace)
+	if err != nil {
+		return err
+	}
+
+	if sub.CancelAtPeriodEnd && !sub.CurrentPeriodEnd.After(now) {
+		toStatus, err := validateTransition(sub, SubscriptionActionExpire)
+		if err != nil {
+			return err
+		}
+		if sub.ProviderSubscriptionId != nil {
+			err = provider.CancelSubscription(sub, false)
+			if err != nil {
+				// stripe cancels on its own at period end so this may already be gone
+				fmt.Printf("could not cancel provider subscription for workspace %d: %v\r\n", workspaceId, err)
+			}
+		}
+		_, err = db.Exec("UPDATE subscriptions SET status = ?, scheduled_plan_id = NULL, scheduled_effective_date = NULL, updated_at = ? WHERE id = ?", toStatus, now, sub.Id)
+		if err != nil {
+			return err
+		}
+		return recordSubscriptionTransition(&SubscriptionTransition{SubscriptionId: sub.Id, WorkspaceId: workspaceId, Action: SubscriptionActionExpire, FromStatus: sub.Status, ToStatus: toStatus, FromPlanId: sub.CurrentPlanId, ToPlanId: sub.CurrentPlanId, CreatedAt: now})
+	}
+
+	if sub.ScheduledPlanId == nil || sub.ScheduledEffectiveDate == nil || sub.ScheduledEffectiveDate.After(now) {
+		return nil
+	}
+	toStatus, err := validateTransition(sub, SubscriptionActionApplyScheduled)
+	if err != nil {
+		return err
+	}
+	plan, err := GetServicePlan(*sub.ScheduledPlanId)
+	if err != nil {
+		return err
+	}
+	if sub.ProviderSubscriptionId != nil {
+		providerSub, err := provider.ChangeSubscription(sub, plan, sub.BillingCycle)
+		if err != nil {
+			return err
+		}
+		if providerSub.ApprovalUrl != "" {
+			// switched by ConfirmPendingPlanChange once approved
+			err = savePendingPlanChange(&PendingPlanChange{SubscriptionId: sub.Id, WorkspaceId: workspaceId, Action: SubscriptionActionApplyScheduled, PlanId: plan.Id, BillingCycle: sub.BillingCycle,
+				ProviderSubscriptionId: providerSub.Id, ProviderPlanId: providerSub.PlanId, ApprovalUrl: providerSub.ApprovalUrl, CreatedAt: now})
+			if err != nil {
+				return err
+			}
+			_, err = db.Exec("UPDATE subscriptions SET scheduled_plan_id = NULL, scheduled_effective_date = NULL, updated_at = ? WHERE id = ?", now, sub.Id)
+			if err != nil {
+				return err
+			}
+			notifyPlanChangeApproval(workspace, plan, providerSub.ApprovalUrl)
+			return nil
+		}
+	}
+	_, err = db.Exec("UPDATE subscriptions SET current_plan_id = ?, scheduled_plan_id = NULL, scheduled_effective_date = NULL, updated_at = ? WHERE id = ?", plan.Id, now, sub.Id)
+	if err != nil {
+		return err
+	}
+	return recordSubscriptionTransition(&SubscriptionTransition{SubscriptionId: sub.Id, WorkspaceId: workspaceId, Action: SubscriptionActionApplyScheduled, FromStatus: sub.Status, ToStatus: toStatus, FromPlanId: sub.CurrentPlanId, ToPlanId: plan.Id, CreatedAt: now})
+}
+
+// notifyPlanChangeApproval asks the owner to approve a scheduled plan change with the provider
+func notifyPlanChangeApproval(workspace *Workspace, plan *ServicePlan, approvalUrl string) {
+	user, err := GetUserFromDB(workspace.CreatorId)
+	if err != nil {
+		fmt.Printf("could not get user for plan change approval: %v\r\n", err)
+		return
+	}
+	body := fmt.Sprintf(`Your workspace %s is moving to the %s plan. Please approve the change with your payment provider: %s`,
+		workspace.Name, plan.NiceName, approvalUrl)
+	SendEmail(user, "Approve your plan change", body)
+}
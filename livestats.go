@@ -0,0 +1,380 @@
+package helpers
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const (
+	LiveStatCallCount  = "live_call_count"
+	LiveStatCPUPCTUsed = "live_cpu_pct_used"
+	LiveStatMemPCTUsed = "live_mem_pct_used"
+	LiveStatUptime     = "live_uptime_seconds"
+	LiveStatStatus     = "live_status"
+	LiveStatUpdatedAt  = "live_updated_at"
+)
+
+// liveStatColumns are the only columns live stat updates may write
+var liveStatColumns = map[string]bool{
+	LiveStatCallCount:  true,
+	LiveStatCPUPCTUsed: true,
+	LiveStatMemPCTUsed: true,
+	LiveStatUptime:     true,
+	LiveStatStatus:     true,
+	LiveStatUpdatedAt:  true,
+}
+
+// live stat tables keyed by member kind
+var liveStatTables = map[string]string{
+	MemberKindMediaServer: "media_servers",
+	MemberKindSIPRouter:   "sip_routers",
+}
+
+const defaultLiveStatsFlushInterval = 10 * time.Second
+
+// LiveStats is a node's stats report. nil fields weren't reported and are left as is.
+type LiveStats struct {
+	LiveCallCount  *int     `json:"live_call_count"`
+	LiveCPUPCTUsed *float64 `json:"live_cpu_pct_used"`
+	LiveMemPCTUsed *float64 `json:"live_mem_pct_used"`
+	UptimeSeconds  *int64   `json:"live_uptime_seconds"`
+	// Status is left as is when empty, reported statuses never override drains
+	Status    string    `json:"live_status"`
+	UpdatedAt time.Time `json:"live_updated_at"`
+}
+
+func IsValidLiveStat(stat string) bool {
+	return liveStatColumns[stat]
+}
+
+func IsValidNodeStatus(status string) bool {
+	switch status {
+	case NodeStatusOnline, NodeStatusDraining, NodeStatusMaintenance, NodeStatusUnhealthy, NodeStatusOffline:
+		return true
+	}
+	return false
+}
+
+func (stats *LiveStats) columns() (map[string]interface{}, error) {
+	if stats.Status != "" && !IsValidNodeStatus(stats.Status) {
+		return nil, fmt.Errorf("invalid node status %s", stats.Status)
+	}
+	updatedAt := stats.UpdatedAt
+	if updatedAt.IsZero() {
+		updatedAt = time.Now()
+	}
+	columns := map[string]interface{}{LiveStatUpdatedAt: updatedAt}
+	if stats.LiveCallCount != nil {
+		columns[LiveStatCallCount] = *stats.LiveCallCount
+	}
+	if stats.LiveCPUPCTUsed != nil {
+		columns[LiveStatCPUPCTUsed] = *stats.LiveCPUPCTUsed
+	}
+	if stats.LiveMemPCTUsed != nil {
+		columns[LiveStatMemPCTUsed] = *stats.LiveMemPCTUsed
+	}
+	if stats.UptimeSeconds != nil {
+		columns[LiveStatUptime] = *stats.UptimeSeconds
+	}
+	if stats.Status != "" {
+		columns[LiveStatStatus] = stats.Status
+	}
+	return columns, nil
+}
+
+// sets live_status in the cache unless an operator drained the node or put it in maintenance
+const guardedLiveStatusScript = `
+local current = redis.call("hget", KEYS[1], "live_status")
+if current == ARGV[2] or current == ARGV[3] then return 0 end
+redis.call("hset", KEYS[1], "live_status", ARGV[1])
+return 1`
+
+func isOperatorNodeStatus(status string) bool {
+	return status == NodeStatusDraining || status == NodeStatusMaintenance
+}
+
+func liveStatsKey(kind string, id int) string {
+	return fmt.Sprintf("live_stats:%s:%d", kind, id)
+}
+
+// writeLiveStatColumns updates whitelisted columns of one row. with guardStatus a
+// draining or maintenance live_status is kept, the other columns are still written.
+func writeLiveStatColumns(kind string, id int, columns map[string]interface{}, guardStatus bool) error {
+	table, ok := liveStatTables[kind]
+	if !ok {
+		return fmt.Errorf("unknown live stat kind %s", kind)
+	}
+	sets := make([]string, 0, len(columns))
+	args := make([]interface{}, 0, len(columns)+1)
+	for column, value := range columns {
+		if !IsValidLiveStat(column) {
+			return fmt.Errorf("live stat %s is not permitted", column)
+		}
+		if column == LiveStatStatus && guardStatus {
+			sets = append(sets, "`live_status` = CASE WHEN `live_status` IN (?, ?) THEN `live_status` ELSE ? END")
+			args = append(args, NodeStatusDraining, NodeStatusMaintenance, value)
+			continue
+		}
+		sets = append(sets, "`"+column+"` = ?")
+		args = append(args, value)
+	}
+	if len(sets) == 0 {
+		return nil
+	}
+	args = append(args, id)
+	db, err := CreateDBConn()
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE "+table+" SET "+strings.Join(sets, ", ")+" WHERE id = ?", args...)
+	return err
+}
+
+// writeLiveStatsCache mirrors columns to Redis, guardStatus works as for writeLiveStatColumns
+func writeLiveStatsCache(kind string, id int, columns map[string]interface{}, guardStatus bool) error {
+	rdb, err := CreateRedisConn()
+	if err != nil {
+		return err
+	}
+	key := liveStatsKey(kind, id)
+	values := make(map[string]interface{}, len(columns))
+	for column, value := range columns {
+		if column == LiveStatStatus && guardStatus {
+			err = rdb.Eval(guardedLiveStatusScript, []string{key}, value, NodeStatusDraining, NodeStatusMaintenance).Err()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if t, ok := value.(time.Time); ok {
+			value = t.Unix()
+		}
+		values[column] = value
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	return rdb.HMSet(key, values).Err()
+}
+
+// GetLiveStats reads the latest stats reported for a node from Redis
+func GetLiveStats(kind string, id int) (*LiveStats, error) {
+	rdb, err := CreateRedisConn()
+	if err != nil {
+		return nil, err
+	}
+	values, err := rdb.HGetAll(liveStatsKey(kind, id)).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	stats := &LiveStats{Status: values[LiveStatStatus]}
+	if val, err := strconv.Atoi(values[LiveStatCallCount]); err == nil {
+		stats.LiveCallCount = &val
+	}
+	if val, err := strconv.ParseFloat(values[LiveStatCPUPCTUsed], 64); err == nil {
+		stats.LiveCPUPCTUsed = &val
+	}
+	if val, err := strconv.ParseFloat(values[LiveStatMemPCTUsed], 64); err == nil {
+		stats.LiveMemPCTUsed = &val
+	}
+	if val, err := strconv.ParseInt(values[LiveStatUptime], 10, 64); err == nil {
+		stats.UptimeSeconds = &val
+	}
+	if ts, err := strconv.ParseInt(values[LiveStatUpdatedAt], 10, 64); err == nil {
+		stats.UpdatedAt = time.Unix(ts, 0)
+	}
+	return stats, nil
+}
+
+type liveStatsEntry struct {
+	kind    string
+	id      int
+	columns map[string]interface{}
+}
+
+// LiveStatsRecorder writes stats to Redis as they arrive and batches them to MySQL.
+// only the newest value per node and column is flushed.
+type LiveStatsRecorder struct {
+	mu      sync.Mutex
+	pending map[string]*liveStatsEntry
+	stop    chan struct{}
+}
+
+var liveStatsRecorder *LiveStatsRecorder
+var liveStatsRecorderOnce sync.Once
+
+func NewLiveStatsRecorder() *LiveStatsRecorder {
+	return &LiveStatsRecorder{pending: make(map[string]*liveStatsEntry)}
+}
+
+// GetLiveStatsRecorder returns the shared recorder, flushing every 10 seconds
+func GetLiveStatsRecorder() *LiveStatsRecorder {
+	liveStatsRecorderOnce.Do(func() {
+		liveStatsRecorder = NewLiveStatsRecorder()
+		liveStatsRecorder.Start(defaultLiveStatsFlushInterval)
+	})
+	return liveStatsRecorder
+}
+
+func (r *LiveStatsRecorder) Record(kind string, id int, stats *LiveStats) error {
+	if _, ok := liveStatTables[kind]; !ok {
+		return fmt.Errorf("unknown live stat kind %s", kind)
+	}
+	columns, err := stats.columns()
+	if err != nil {
+		return err
+	}
+	err = writeLiveStatsCache(kind, id, columns, true)
+	if err != nil {
+		return err
+	}
+	r.queue(kind, id, columns)
+	return nil
+}
+
+func (r *LiveStatsRecorder) queue(kind string, id int, columns map[string]interface{}) {
+	key := liveStatsKey(kind, id)
+	r.mu.Lock()
+	entry, ok := r.pending[key]
+	if !ok {
+		entry = &liveStatsEntry{kind: kind, id: id, columns: make(map[string]interface{})}
+		r.pending[key] = entry
+	}
+	for column, value := range columns {
+		entry.columns[column] = value
+	}
+	r.mu.Unlock()
+}
+
+// Flush writes all pending stats to MySQL. entries that fail are requeued unless a
+// newer value arrived in the meantime.
+func (r *LiveStatsRecorder) Flush() error {
+	r.mu.Lock()
+	pending := r.pending
+	r.pending = make(map[string]*liveStatsEntry)
+	r.mu.Unlock()
+
+	var lastErr error
+	for key, entry := range pending {
+		err := writeLiveStatColumns(entry.kind, entry.id, entry.columns, true)
+		if err != nil {
+			fmt.Printf("could not flush live stats for %s: %v\r\n", key, err)
+			lastErr = err
+			r.mu.Lock()
+			if _, ok := r.pending[key]; !ok {
+				r.pending[key] = entry
+			}
+			r.mu.Unlock()
+		}
+	}
+	return lastErr
+}
+
+func (r *LiveStatsRecorder) Start(interval time.Duration) {
+	r.mu.Lock()
+	if r.stop != nil {
+		r.mu.Unlock()
+		return
+	}
+	stop := make(chan struct{})
+	r.stop = stop
+	r.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				r.Flush()
+			case <-stop:
+				r.Flush()
+				return
+			}
+		}
+	}()
+}
+
+// Stop flushes what is pending and stops the background flush
+func (r *LiveStatsRecorder) Stop() {
+	r.mu.Lock()
+	stop := r.stop
+	r.stop = nil
+	r.mu.Unlock()
+	if stop != nil {
+		close(stop)
+	}
+}
+
+func RecordMediaServerStats(server *MediaServer, stats *LiveStats) error {
+	return GetLiveStatsRecorder().Record(MemberKindMediaServer, server.Id, stats)
+}
+
+func RecordRouterStats(router *SIPRouter, stats *LiveStats) error {
+	return GetLiveStatsRecorder().Record(MemberKindSIPRouter, router.Id, stats)
+}
+
+// updateLiveStatNow writes a single whitelisted column straight through, for
+// status changes that shouldn't wait for the next flush. it's used for operator
+// changes so it may override a drain.
+func updateLiveStatNow(kind string, id int, stat string, value string) error {
+	if !IsValidLiveStat(stat) {
+		return fmt.Errorf("live stat %s is not permitted", stat)
+	}
+	if stat == LiveStatStatus && !IsValidNodeStatus(value) {
+		return fmt.Errorf("invalid node status %s", value)
+	}
+	columns := map[string]interface{}{stat: value}
+	err := writeLiveStatsCache(kind, id, columns, false)
+	if err != nil {
+		fmt.Printf("could not cache live stat %s: %v\r\n", stat, err)
+	}
+	return writeLiveStatColumns(kind, id, columns, false)
+}
+
+// SetNodeHealth flips live_status between online and unhealthy from health signals.
+// nodes an operator put in draining or maintenance keep that status.
+func SetNodeHealth(kind string, id int, status string) error {
+	table, ok := liveStatTables[kind]
+	if !ok {
+		return fmt.Errorf("unknown live stat kind %s", kind)
+	}
+	if !IsValidNodeStatus(status) {
+		return fmt.Errorf("invalid node status %s", status)
+	}
+	db, err := CreateDBConn()
+	if err != nil {
+		return err
+	}
+	res, err := db.Exec("UPDATE "+table+" SET live_status = ? WHERE id = ? AND (live_status IS NULL OR live_status NOT IN (?, ?))",
+		status, id, NodeStatusDraining, NodeStatusMaintenance)
+	if err != nil {
+		return err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		// mysql reports changed rows, so 0 also means the status was already set. only
+		// skip the cache when the guard kept a drain or the node doesn't exist.
+		var current sql.NullString
+		err = db.QueryRow("SELECT live_status FROM "+table+" WHERE id = ?", id).Scan(&current)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if isOperatorNodeStatus(current.String) {
+			return nil
+		}
+	}
+	return writeLiveStatsCache(kind, id, map[string]interface{}{LiveStatStatus: status}, true)
+}
@@ -0,0 +1,230 @@
+package helpers
+
+import (
+	"errors"
+	"hash/fnv"
+	"math/rand"
+	"os"
+	"strconv"
+)
+
+const (
+	NodeStatusOnline      = "online"
+	NodeStatusDraining    = "draining"
+	NodeStatusMaintenance = "maintenance"
+	NodeStatusUnhealthy   = "unhealthy"
+	NodeStatusOffline     = "offline"
+)
+
+const (
+	LoadBalancingLeastCalls     = "least-calls"
+	LoadBalancingWeightedCPU    = "weighted-cpu"
+	LoadBalancingConsistentHash = "consistent-hash"
+	LoadBalancingWebRTCAware    = "webrtc-aware"
+)
+
+var ErrNoMediaServerAvailable = errors.New("no media server available")
+
+// MediaServerRequest describes the call a media server is being picked for
+type MediaServerRequest struct {
+	// CallId keeps retries of the same call on the same server with consistent hashing
+	CallId string
+	WebRTC bool
+}
+
+// LoadBalancingStrategy picks one of the given servers, which are already filtered
+// down to the ones that can take calls
+type LoadBalancingStrategy interface {
+	Select(servers []*MediaServer, req *MediaServerRequest) (*MediaServer, error)
+}
+
+type LoadBalancer struct {
+	Strategy LoadBalancingStrategy
+	// Servers loads the candidate servers, tests can inject a fixed list
+	Servers func() ([]*MediaServer, error)
+}
+
+func NewLoadBalancer(strategy LoadBalancingStrategy, servers func() ([]*MediaServer, error)) *LoadBalancer {
+	return &LoadBalancer{Strategy: strategy, Servers: servers}
+}
+
+func NewStaticLoadBalancer(strategy LoadBalancingStrategy, servers []*MediaServer) *LoadBalancer {
+	return NewLoadBalancer(strategy, func() ([]*MediaServer, error) {
+		return servers, nil
+	})
+}
+
+// IsNodeAvailable tells whether a node with the given live status can take new calls
+func IsNodeAvailable(status string) bool {
+	switch status {
+	case NodeStatusDraining, NodeStatusMaintenance, NodeStatusUnhealthy, NodeStatusOffline:
+		return false
+	}
+	return true
+}
+
+func FilterAvailableMediaServers(servers []*MediaServer) []*MediaServer {
+	available := make([]*MediaServer, 0, len(servers))
+	for _, server := range servers {
+		if server != nil && IsNodeAvailable(server.Status) {
+			available = append(available, server)
+		}
+	}
+	return available
+}
+
+func (lb *LoadBalancer) Select(req *MediaServerRequest) (*MediaServer, error) {
+	if req == nil {
+		req = &MediaServerRequest{}
+	}
+	servers, err := lb.Servers()
+	if err != nil {
+		return nil, err
+	}
+	available := FilterAvailableMediaServers(servers)
+	if len(available) == 0 {
+		return nil, ErrNoMediaServerAvailable
+	}
+	return lb.Strategy.Select(available, req)
+}
+
+type LeastCallsStrategy struct{}
+
+func (s *LeastCallsStrategy) Select(servers []*MediaServer, req *MediaServerRequest) (*MediaServer, error) {
+	var best *MediaServer
+	for _, server := range servers {
+		if best == nil || server.LiveCallCount < best.LiveCallCount ||
+			(server.LiveCallCount == best.LiveCallCount && server.LiveCPUPCTUsed < best.LiveCPUPCTUsed) {
+			best = server
+		}
+	}
+	if best == nil {
+		return nil, ErrNoMediaServerAvailable
+	}
+	return best, nil
+}
+
+// WeightedCPUStrategy picks at random, weighting each server by its idle CPU
+type WeightedCPUStrategy struct {
+	// Rand can be set for deterministic selection, the global source is used otherwise
+	Rand *rand.Rand
+}
+
+func (s *WeightedCPUStrategy) Select(servers []*MediaServer, req *MediaServerRequest) (*MediaServer, error) {
+	weights := make([]float64, len(servers))
+	total := 0.0
+	for i, server := range servers {
+		idle := 100 - server.LiveCPUPCTUsed
+		if idle < 0 {
+			idle = 0
+		}
+		weights[i] = idle
+		total += idle
+	}
+	if total == 0 {
+		// everything is saturated, spread by call count instead
+		return (&LeastCallsStrategy{}).Select(servers, req)
+	}
+	var pick float64
+	if s.Rand != nil {
+		pick = s.Rand.Float64() * total
+	} else {
+		pick = rand.Float64() * total
+	}
+	for i, weight := range weights {
+		if pick < weight {
+			return servers[i], nil
+		}
+		pick -= weight
+	}
+	return servers[len(servers)-1], nil
+}
+
+// ConsistentHashStrategy maps a call id to the same server as long as that server is
+// available, using rendezvous hashing so only calls on a removed server move
+type ConsistentHashStrategy struct {
+	// Fallback is used for requests without a call id
+	Fallback LoadBalancingStrategy
+}
+
+func hashServerKey(callId string, serverId int) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(callId))
+	h.Write([]byte(":"))
+	h.Write([]byte(strconv.Itoa(serverId)))
+	return h.Sum64()
+}
+
+func (s *ConsistentHashStrategy) Select(servers []*MediaServer, req *MediaServerRequest) (*MediaServer, error) {
+	if req.CallId == "" {
+		fallback := s.Fallback
+		if fallback == nil {
+			fallback = &LeastCallsStrategy{}
+		}
+		return fallback.Select(servers, req)
+	}
+	var best *MediaServer
+	var bestScore uint64
+	for _, server := range servers {
+		score := hashServerKey(req.CallId, server.Id)
+		if best == nil || score > bestScore {
+			best = server
+			bestScore = score
+		}
+	}
+	if best == nil {
+		return nil, ErrNoMediaServerAvailable
+	}
+	return best, nil
+}
+
+// WebRTCAwareStrategy sends WebRTC calls to RTC optimized servers and keeps other calls
+// off them while there is capacity elsewhere
+type WebRTCAwareStrategy struct {
+	Inner LoadBalancingStrategy
+}
+
+func (s *WebRTCAwareStrategy) Select(servers []*MediaServer, req *MediaServerRequest) (*MediaServer, error) {
+	inner := s.Inner
+	if inner == nil {
+		inner = &LeastCallsStrategy{}
+	}
+	preferred := make([]*MediaServer, 0, len(servers))
+	for _, server := range servers {
+		if server.RtcOptimized == req.WebRTC {
+			preferred = append(preferred, server)
+		}
+	}
+	if len(preferred) == 0 {
+		return inner.Select(servers, req)
+	}
+	return inner.Select(preferred, req)
+}
+
+// GetLoadBalancingStrategy returns the strategy for name, defaulting to least calls
+func GetLoadBalancingStrategy(name string) LoadBalancingStrategy {
+	switch name {
+	case LoadBalancingWeightedCPU:
+		return &WeightedCPUStrategy{}
+	case LoadBalancingConsistentHash:
+		return &ConsistentHashStrategy{}
+	case LoadBalancingWebRTCAware:
+		return &WebRTCAwareStrategy{}
+	}
+	return &LeastCallsStrategy{}
+}
+
+// CreateLoadBalancer builds a balancer over the media_servers table using the
+// strategy set in MEDIA_SERVER_LB_STRATEGY. nodes reported dead by gossip are
+// skipped when membership is running.
+func CreateLoadBalancer() *LoadBalancer {
+	source := CreateMediaServers
+	if m := GetMembership(); m != nil {
+		source = m.MediaServerSource(source)
+	}
+	return NewLoadBalancer(GetLoadBalancingStrategy(os.Getenv("MEDIA_SERVER_LB_STRATEGY")), source)
+}
+
+func SelectMediaServer(req *MediaServerRequest) (*MediaServer, error) {
+	return CreateLoadBalancer().Select(req)
+}
@@ -0,0 +1,176 @@
+package helpers
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func testMediaServer(id int, status string, calls int, cpu float64, rtc bool) *MediaServer {
+	return &MediaServer{Id: id, Status: status, LiveCallCount: calls, LiveCPUPCTUsed: cpu, RtcOptimized: rtc}
+}
+
+func TestLoadBalancerSkipsUnavailableServers(t *testing.T) {
+	servers := []*MediaServer{
+		testMediaServer(1, NodeStatusDraining, 0, 0, false),
+		testMediaServer(2, NodeStatusUnhealthy, 0, 0, false),
+		testMediaServer(3, NodeStatusMaintenance, 0, 0, false),
+		testMediaServer(4, NodeStatusOffline, 0, 0, false),
+		testMediaServer(5, NodeStatusOnline, 50, 90, false),
+	}
+	strategies := map[string]LoadBalancingStrategy{
+		LoadBalancingLeastCalls:     &LeastCallsStrategy{},
+		LoadBalancingWeightedCPU:    &WeightedCPUStrategy{Rand: rand.New(rand.NewSource(1))},
+		LoadBalancingConsistentHash: &ConsistentHashStrategy{},
+		LoadBalancingWebRTCAware:    &WebRTCAwareStrategy{},
+	}
+	for name, strategy := range strategies {
+		t.Run(name, func(t *testing.T) {
+			lb := NewStaticLoadBalancer(strategy, servers)
+			for i := 0; i < 20; i++ {
+				server, err := lb.Select(&MediaServerRequest{CallId: fmt.Sprintf("call-%d", i)})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if server.Id != 5 {
+					t.Fatalf("expected the only online server, got %d", server.Id)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadBalancerNoServers(t *testing.T) {
+	lb := NewStaticLoadBalancer(&LeastCallsStrategy{}, []*MediaServer{testMediaServer(1, NodeStatusDraining, 0, 0, false)})
+	_, err := lb.Select(nil)
+	if err != ErrNoMediaServerAvailable {
+		t.Fatalf("expected ErrNoMediaServerAvailable, got %v", err)
+	}
+}
+
+func TestLeastCallsStrategy(t *testing.T) {
+	servers := []*MediaServer{
+		testMediaServer(1, NodeStatusOnline, 10, 20, false),
+		testMediaServer(2, NodeStatusOnline, 3, 60, false),
+		testMediaServer(3, NodeStatusOnline, 3, 40, false),
+	}
+	server, err := NewStaticLoadBalancer(&LeastCallsStrategy{}, servers).Select(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ties on calls go to the server with less CPU in use
+	if server.Id != 3 {
+		t.Fatalf("expected server 3, got %d", server.Id)
+	}
+}
+
+func TestWeightedCPUStrategy(t *testing.T) {
+	servers := []*MediaServer{
+		testMediaServer(1, NodeStatusOnline, 0, 100, false),
+		testMediaServer(2, NodeStatusOnline, 0, 20, false),
+		testMediaServer(3, NodeStatusOnline, 0, 60, false),
+	}
+	lb := NewStaticLoadBalancer(&WeightedCPUStrategy{Rand: rand.New(rand.NewSource(42))}, servers)
+	picks := make(map[int]int)
+	for i := 0; i < 1000; i++ {
+		server, err := lb.Select(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		picks[server.Id]++
+	}
+	if picks[1] != 0 {
+		t.Fatalf("expected the saturated server to get no calls, got %d", picks[1])
+	}
+	// 80% idle against 40% idle
+	if picks[2] <= picks[3] {
+		t.Fatalf("expected the idler server to get more calls, got %v", picks)
+	}
+}
+
+func TestWeightedCPUStrategyAllSaturated(t *testing.T) {
+	servers := []*MediaServer{
+		testMediaServer(1, NodeStatusOnline, 9, 100, false),
+		testMediaServer(2, NodeStatusOnline, 4, 100, false),
+	}
+	server, err := NewStaticLoadBalancer(&WeightedCPUStrategy{}, servers).Select(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.Id != 2 {
+		t.Fatalf("expected the least busy server, got %d", server.Id)
+	}
+}
+
+func TestConsistentHashStrategyIsSticky(t *testing.T) {
+	servers := []*MediaServer{
+		testMediaServer(1, NodeStatusOnline, 0, 0, false),
+		testMediaServer(2, NodeStatusOnline, 0, 0, false),
+		testMediaServer(3, NodeStatusOnline, 0, 0, false),
+		testMediaServer(4, NodeStatusOnline, 0, 0, false),
+	}
+	lb := NewStaticLoadBalancer(&ConsistentHashStrategy{}, servers)
+	assigned := make(map[string]int)
+	for i := 0; i < 200; i++ {
+		callId := fmt.Sprintf("call-%d", i)
+		first, err := lb.Select(&MediaServerRequest{CallId: callId})
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, err := lb.Select(&MediaServerRequest{CallId: callId})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first.Id != again.Id {
+			t.Fatalf("expected %s to stay on server %d, got %d", callId, first.Id, again.Id)
+		}
+		assigned[callId] = first.Id
+	}
+
+	// draining a server only moves the calls that were on it
+	servers[1].Status = NodeStatusDraining
+	for callId, id := range assigned {
+		server, err := lb.Select(&MediaServerRequest{CallId: callId})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != 2 && server.Id != id {
+			t.Fatalf("expected %s to stay on server %d, got %d", callId, id, server.Id)
+		}
+		if server.Id == 2 {
+			t.Fatalf("expected %s to move off the draining server", callId)
+		}
+	}
+}
+
+func TestWebRTCAwareStrategy(t *testing.T) {
+	servers := []*MediaServer{
+		testMediaServer(1, NodeStatusOnline, 0, 0, false),
+		testMediaServer(2, NodeStatusOnline, 5, 0, true),
+	}
+	lb := NewStaticLoadBalancer(&WebRTCAwareStrategy{}, servers)
+	server, err := lb.Select(&MediaServerRequest{WebRTC: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.Id != 2 {
+		t.Fatalf("expected the RTC optimized server, got %d", server.Id)
+	}
+	server, err = lb.Select(&MediaServerRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.Id != 1 {
+		t.Fatalf("expected the plain server, got %d", server.Id)
+	}
+
+	// with no RTC optimized server available WebRTC calls still get placed
+	servers[1].Status = NodeStatusUnhealthy
+	server, err = lb.Select(&MediaServerRequest{WebRTC: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.Id != 1 {
+		t.Fatalf("expected the plain server, got %d", server.Id)
+	}
+}
@@ -0,0 +1,311 @@
+package helpers
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/clockworksoul/smudge"
+)
+
+type MemberState string
+
+const (
+	MemberUnknown   MemberState = "unknown"
+	MemberAlive     MemberState = "alive"
+	MemberSuspected MemberState = "suspected"
+	MemberDead      MemberState = "dead"
+)
+
+const (
+	MemberKindMediaServer = "media_server"
+	MemberKindSIPRouter   = "sip_router"
+)
+
+// heartbeat used when SMUDGE_HEARTBEAT_MS is not set, low enough that dead nodes
+// are noticed within a few seconds
+const defaultMembershipHeartbeatMillis = 500
+
+type ClusterMember struct {
+	Kind        string       `json:"kind"`
+	Id          int          `json:"id"`
+	Address     string       `json:"address"`
+	State       MemberState  `json:"state"`
+	ChangedAt   time.Time    `json:"changed_at"`
+	MediaServer *MediaServer `json:"-"`
+	Router      *SIPRouter   `json:"-"`
+}
+
+type MemberEvent struct {
+	Member   ClusterMember `json:"member"`
+	Previous MemberState   `json:"previous"`
+}
+
+// Membership tracks the gossip state of media servers and SIP routers. it implements
+// smudge.StatusListener so smudge pushes status changes into it.
+type Membership struct {
+	mu       sync.RWMutex
+	members  map[string]*ClusterMember
+	watchers map[int]chan MemberEvent
+	nextId   int
+	// persist writes state changes to live_status, it can be replaced in tests
+	persist func(member *ClusterMember) error
+}
+
+var membership *Membership
+var membershipMu sync.RWMutex
+
+func NewMembership() *Membership {
+	return &Membership{
+		members:  make(map[string]*ClusterMember),
+		watchers: make(map[int]chan MemberEvent),
+		persist:  persistMemberState,
+	}
+}
+
+// GetMembership returns the running membership, or nil when StartMembership was not called
+func GetMembership() *Membership {
+	membershipMu.RLock()
+	defer membershipMu.RUnlock()
+	return membership
+}
+
+var memberKinds = []string{MemberKindMediaServer, MemberKindSIPRouter}
+
+// memberAddress is the gossip address of a node, the smudge ip:port when it has a node
+func memberAddress(ipAddress string, node *smudge.Node) string {
+	if node != nil {
+		return node.Address()
+	}
+	return ipAddress
+}
+
+// memberKey includes the kind so a media server and a router on one host don't collide
+func memberKey(kind string, address string) string {
+	return kind + "/" + address
+}
+
+func (m *Membership) AddMediaServer(server *MediaServer) {
+	m.add(&ClusterMember{Kind: MemberKindMediaServer, Id: server.Id, Address: memberAddress(server.IpAddress, server.Node), State: MemberUnknown, MediaServer: server})
+}
+
+func (m *Membership) AddSIPRouter(router *SIPRouter) {
+	m.add(&ClusterMember{Kind: MemberKindSIPRouter, Id: router.Id, Address: memberAddress(router.IpAddress, router.Node), State: MemberUnknown, Router: router})
+}
+
+func (m *Membership) add(member *ClusterMember) {
+	member.ChangedAt = time.Now()
+	m.mu.Lock()
+	m.members[memberKey(member.Kind, member.Address)] = member
+	m.mu.Unlock()
+}
+
+// OnChange is called by smudge whenever a cluster member changes status
+func (m *Membership) OnChange(node *smudge.Node, status smudge.NodeStatus) {
+	m.SetState(node.Address(), memberStateFromSmudge(status))
+}
+
+func memberStateFromSmudge(status smudge.NodeStatus) MemberState {
+	switch status {
+	case smudge.StatusAlive:
+		return MemberAlive
+	case smudge.StatusSuspected:
+		return MemberSuspected
+	case smudge.StatusDead:
+		return MemberDead
+	}
+	return MemberUnknown
+}
+
+// SetState records a new state for every member gossiping from address, one host
+// can run both a media server and a router, and notifies watchers
+func (m *Membership) SetState(address string, state MemberState) {
+	events := make([]MemberEvent, 0, len(memberKinds))
+	m.mu.Lock()
+	for _, kind := range memberKinds {
+		member, ok := m.members[memberKey(kind, address)]
+		if !ok || member.State == state {
+			continue
+		}
+		event := MemberEvent{Previous: member.State}
+		member.State = state
+		member.ChangedAt = time.Now()
+		event.Member = *member
+		for _, watcher := range m.watchers {
+			select {
+			case watcher <- event:
+			default:
+				// slow watchers miss events rather than block gossip
+			}
+		}
+		events = append(events, event)
+	}
+	m.mu.Unlock()
+
+	if m.persist == nil {
+		return
+	}
+	for i := range events {
+		member := &events[i].Member
+		err := m.persist(member)
+		if err != nil {
+			fmt.Printf("could not update live status for %s %d: %v\r\n", member.Kind, member.Id, err)
+		}
+	}
+}
+
+// Watch returns a channel of state changes and a function to stop watching
+func (m *Membership) Watch() (<-chan MemberEvent, func()) {
+	ch := make(chan MemberEvent, 64)
+	m.mu.Lock()
+	id := m.nextId
+	m.nextId++
+	m.watchers[id] = ch
+	m.mu.Unlock()
+	return ch, func() {
+		m.mu.Lock()
+		if _, ok := m.watchers[id]; ok {
+			delete(m.watchers, id)
+			close(ch)
+		}
+		m.mu.Unlock()
+	}
+}
+
+// Members returns a snapshot of all tracked members
+func (m *Membership) Members() []ClusterMember {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	members := make([]ClusterMember, 0, len(m.members))
+	for _, member := range m.members {
+		members = append(members, *member)
+	}
+	return members
+}
+
+func (m *Membership) GetState(kind string, address string) MemberState {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	member, ok := m.members[memberKey(kind, address)]
+	if !ok {
+		return MemberUnknown
+	}
+	return member.State
+}
+
+// FilterMediaServers drops servers that gossip reports as suspected or dead
+func (m *Membership) FilterMediaServers(servers []*MediaServer) []*MediaServer {
+	live := make([]*MediaServer, 0, len(servers))
+	for _, server := range servers {
+		state := m.GetState(MemberKindMediaServer, memberAddress(server.IpAddress, server.Node))
+		if state == MemberSuspected || state == MemberDead {
+			continue
+		}
+		live = append(live, server)
+	}
+	return live
+}
+
+// MediaServerSource wraps a server loader so the load balancer skips dead nodes
+// without waiting for live_status to be written
+func (m *Membership) MediaServerSource(source func() ([]*MediaServer, error)) func() ([]*MediaServer, error) {
+	return func() ([]*MediaServer, error) {
+		servers, err := source()
+		if err != nil {
+			return nil, err
+		}
+		return m.FilterMediaServers(servers), nil
+	}
+}
+
+// persistMemberState writes gossip state to live_status unless a health checker is
+// probing the node, SIP OPTIONS results take precedence over gossip
+func persistMemberState(member *ClusterMember) error {
+	claimed, err := IsNodeHealthClaimed(member.Kind, member.Id)
+	if err != nil {
+		return err
+	}
+	if claimed {
+		return nil
+	}
+	status := NodeStatusOnline
+	switch member.State {
+	case MemberSuspected:
+		status = NodeStatusUnhealthy
+	case MemberDead:
+		status = NodeStatusOffline
+	case MemberUnknown:
+		return nil
+	}
+	return SetNodeHealth(member.Kind, member.Id, status)
+}
+
+func configureSmudge() error {
+	if val := os.Getenv("SMUDGE_LISTEN_PORT"); val != "" {
+		port, err := strconv.Atoi(val)
+		if err != nil {
+			return err
+		}
+		smudge.SetListenPort(port)
+	}
+	heartbeat := defaultMembershipHeartbeatMillis
+	if val := os.Getenv("SMUDGE_HEARTBEAT_MS"); val != "" {
+		millis, err := strconv.Atoi(val)
+		if err != nil {
+			return err
+		}
+		heartbeat = millis
+	}
+	smudge.SetHeartbeatMillis(heartbeat)
+	if val := os.Getenv("SMUDGE_CLUSTER_NAME"); val != "" {
+		smudge.SetClusterName(val)
+	}
+	return nil
+}
+
+// StartMembership joins the smudge cluster with every media server and SIP router as a
+// member and starts tracking their status. smudge runs in the background.
+func StartMembership() (*Membership, error) {
+	// held throughout so concurrent callers don't start smudge twice
+	membershipMu.Lock()
+	defer membershipMu.Unlock()
+	if membership != nil {
+		return membership, nil
+	}
+	err := configureSmudge()
+	if err != nil {
+		return nil, err
+	}
+	m := NewMembership()
+
+	servers, err := CreateMediaServers()
+	if err != nil {
+		return nil, err
+	}
+	for _, server := range servers {
+		m.AddMediaServer(server)
+		_, err = smudge.AddNode(server.Node)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	routers, err := GetSIPRouters()
+	if err != nil {
+		return nil, err
+	}
+	for _, router := range routers {
+		m.AddSIPRouter(router)
+		_, err = smudge.AddNode(router.Node)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	smudge.AddStatusListener(m)
+	go smudge.Begin()
+	membership = m
+	return m, nil
+}
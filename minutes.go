@@ -0,0 +1,163 @@
+package helpers
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// takes as many of the requested seconds as are left in the bucket
+const consumeMinutesScript = `
+local used = tonumber(redis.call("get", KEYS[1]) or "0")
+local avail = tonumber(ARGV[1]) - used
+if avail < 0 then avail = 0 end
+local take = tonumber(ARGV[2])
+if take > avail then take = avail end
+if take > 0 then redis.call("incrby", KEYS[1], take) end
+redis.call("expireat", KEYS[1], ARGV[3])
+return take`
+
+// keep buckets around for a while after the period ends for dashboards
+const minutesBucketRetention = 7 * 24 * time.Hour
+
+type MinutesBalance struct {
+	PeriodStart      time.Time `json:"period_start"`
+	PeriodEnd        time.Time `json:"period_end"`
+	IncludedSeconds  int64     `json:"included_seconds"`
+	UsedSeconds      int64     `json:"used_seconds"`
+	RemainingSeconds int64     `json:"remaining_seconds"`
+}
+
+type CallMinutesCharge struct {
+	IncludedSeconds int64 `json:"included_seconds"`
+	OverageSeconds  int64 `json:"overage_seconds"`
+	OverageCents    int   `json:"overage_cents"`
+}
+
+func anchorDate(year int, month time.Month, anchorDay int, loc *time.Location) time.Time {
+	lastDay := time.Date(year, month+1, 0, 0, 0, 0, 0, loc).Day()
+	if anchorDay > lastDay {
+		anchorDay = lastDay
+	}
+	return time.Date(year, month, anchorDay, 0, 0, 0, 0, loc)
+}
+
+// GetBillingPeriod returns the monthly period containing now that starts on anchorDay,
+// anchor days past the end of a short month fall on its last day
+func GetBillingPeriod(anchorDay int, now time.Time) (time.Time, time.Time) {
+	if anchorDay < 1 {
+		anchorDay = 1
+	}
+	start := anchorDate(now.Year(), now.Month(), anchorDay, now.Location())
+	if start.After(now) {
+		start = anchorDate(now.Year(), now.Month()-1, anchorDay, now.Location())
+	}
+	end := anchorDate(start.Year(), start.Month()+1, anchorDay, now.Location())
+	return start, end
+}
+
+func minutesBucketKey(workspaceId int, periodStart time.Time) string {
+	return fmt.Sprintf("minutes:%d:%s", workspaceId, periodStart.Format("20060102"))
+}
+
+func getMinutesAllowance(workspaceId int, now time.Time) (int64, time.Time, time.Time, error) {
+	workspace, err := GetWorkspaceFromDB(workspaceId)
+	if err != nil {
+		return 0, time.Time{}, time.Time{}, err
+	}
+	entitlements, err := GetEntitlements(workspace)
+	if err != nil {
+		return 0, time.Time{}, time.Time{}, err
+	}
+	anchorDay := 1
+	sub, err := GetSubscription(workspaceId)
+	if err != nil && err != ErrSubscriptionNotFound {
+		return 0, time.Time{}, time.Time{}, err
+	}
+	if sub != nil && sub.BillingAnchorDay > 0 {
+		anchorDay = sub.BillingAnchorDay
+	}
+	start, end := GetBillingPeriod(anchorDay, now)
+	return int64(entitlements.Limits.MinutesPerMonth) * 60, start, end, nil
+}
+
+// ConsumeIncludedMinutes takes up to seconds from the workspace's included minutes for
+// the current period and returns how many were covered. safe to call from concurrent calls.
+func ConsumeIncludedMinutes(workspaceId int, seconds int64, now time.Time) (int64, error) {
+	allowance, start, end, err := getMinutesAllowance(workspaceId, now)
+	if err != nil {
+		return 0, err
+	}
+	if allowance <= 0 || seconds <= 0 {
+		return 0, nil
+	}
+	rdb, err := CreateRedisConn()
+	if err != nil {
+		return 0, err
+	}
+	expireAt := end.Add(minutesBucketRetention).Unix()
+	taken, err := rdb.Eval(consumeMinutesScript, []string{minutesBucketKey(workspaceId, start)}, allowance, seconds, expireAt).Int64()
+	if err != nil {
+		return 0, err
+	}
+	return taken, nil
+}
+
+// BillCallMinutes applies included minutes first and prices the rest with the rate engine
+func BillCallMinutes(workspaceId int, number string, typeRate string, seconds int64, now time.Time) (*CallMinutesCharge, error) {
+	included, err := ConsumeIncludedMinutes(workspaceId, seconds, now)
+	if err != nil {
+		return nil, err
+	}
+	charge := &CallMinutesCharge{IncludedSeconds: included, OverageSeconds: seconds - included}
+	if charge.OverageSeconds > 0 {
+		rate := LookupBestCallRate(number, typeRate)
+		// rates are per started minute
+		minutes := math.Ceil(float64(charge.OverageSeconds) / 60)
+		charge.OverageCents = ToCents(rate.CallRate * minutes)
+	}
+	if charge.OverageCents > 0 {
+		// feeds the spend velocity check in CheckOutboundCall
+		err = RecordCallSpend(workspaceId, charge.OverageCents, now)
+		if err != nil {
+			fmt.Printf("could not record call spend for workspace %d: %v\r\n", workspaceId, err)
+		}
+	}
+	return charge, nil
+}
+
+func GetRemainingMinutes(workspaceId int, now time.Time) (*MinutesBalance, error) {
+	allowance, start, end, err := getMinutesAllowance(workspaceId, now)
+	if err != nil {
+		return nil, err
+	}
+	rdb, err := CreateRedisConn()
+	if err != nil {
+		return nil, err
+	}
+	var used int64
+	val, err := rdb.Get(minutesBucketKey(workspaceId, start)).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	if err == nil {
+		used, err = strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+	remaining := allowance - used
+	if remaining < 0 {
+		remaining = 0
+	}
+	return &MinutesBalance{
+		PeriodStart:      start,
+		PeriodEnd:        end,
+		IncludedSeconds:  allowance,
+		UsedSeconds:      used,
+		RemainingSeconds: remaining,
+	}, nil
+}
@@ -0,0 +1,181 @@
+package helpers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/stripe/stripe-go/v71"
+	"github.com/stripe/stripe-go/v71/client"
+)
+
+type PaymentStatus string
+
+// a pending payment may still fail, e.g. a bank debit. don't post credits for it
+// until the payment_intent.succeeded webhook arrives.
+const (
+	PaymentSucceeded      PaymentStatus = "succeeded"
+	PaymentPending        PaymentStatus = "pending"
+	PaymentRequiresAction PaymentStatus = "requires_action"
+	PaymentDeclined       PaymentStatus = "declined"
+)
+
+var ErrNoPaymentMethod = errors.New("no primary payment method on file")
+var ErrPaymentRequiresAction = errors.New("payment requires customer authentication")
+var ErrPaymentDeclined = errors.New("payment was declined")
+
+type PaymentMethod struct {
+	Id       int    `json:"id"`
+	StripeId string `json:"stripe_id"`
+}
+
+type PaymentResult struct {
+	Status          PaymentStatus `json:"status"`
+	PaymentIntentId string        `json:"payment_intent_id"`
+	// ClientSecret is set when Status is requires_action so the frontend can run 3-D Secure
+	ClientSecret string `json:"client_secret"`
+	// ActionUrl is set when the provider needs the payer to approve on its own site
+	ActionUrl   string `json:"action_url"`
+	DeclineCode string `json:"decline_code"`
+	Message     string `json:"message"`
+}
+
+type ChargeReq struct {
+	Cents       int
+	Description string
+	// IdempotencyKey should stay the same across retries of the same charge
+	IdempotencyKey string
+}
+
+func CreateStripeClient() (*client.API, error) {
+	config, err := GetBaseConfig()
+	if err != nil {
+		return nil, err
+	}
+	if config.StripeKey == "" {
+		return nil, errors.New("stripe key is not configured")
+	}
+	return client.New(config.StripeKey, nil), nil
+}
+
+func GetPrimaryPaymentMethod(workspaceId int) (*PaymentMethod, error) {
+	var method PaymentMethod
+	row := db.QueryRow("SELECT id, stripe_id FROM users_cards WHERE workspace_id=? AND `primary`=1", workspaceId)
+
+	err := row.Scan(&method.Id, &method.StripeId)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoPaymentMethod
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &method, nil
+}
+
+func CreatePaymentIdempotencyKey(workspaceId int, purpose string, reference string) string {
+	return fmt.Sprintf("%s_%d_%s", purpose, workspaceId, reference)
+}
+
+// ChargeWorkspace charges the workspace's primary saved payment method off-session.
+// declines and 3-D Secure challenges are reported through the result, not the error.
+func ChargeWorkspace(user *User, workspace *Workspace, req *ChargeReq) (*PaymentResult, error) {
+	sc, err := CreateStripeClient()
+	if err != nil {
+		return nil, err
+	}
+	method, err := GetPrimaryPaymentMethod(workspace.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	params := &stripe.PaymentIntentParams{
+		Amount:        stripe.Int64(int64(req.Cents)),
+		Currency:      stripe.String(string(stripe.CurrencyUSD)),
+		Description:   stripe.String(req.Description),
+		PaymentMethod: stripe.String(method.StripeId),
+		Confirm:       stripe.Bool(true),
+		OffSession:    stripe.Bool(true),
+	}
+	if user.StripeId != "" {
+		params.Customer = stripe.String(user.StripeId)
+	}
+	params.AddMetadata("workspace_id", strconv.Itoa(workspace.Id))
+	params.AddMetadata("user_id", strconv.Itoa(user.Id))
+	key := req.IdempotencyKey
+	if key == "" {
+		key = CreateAPIID("charge")
+	}
+	params.SetIdempotencyKey(key)
+
+	intent, err := sc.PaymentIntents.New(params)
+	if err != nil {
+		return paymentResultFromError(err)
+	}
+	return paymentResultFromIntent(intent), nil
+}
+
+// ChargeCustomer returns nil for pending payments too, they settle through the webhook
+func ChargeCustomer(user *User, workspace *Workspace, cents int, desc string) error {
+	provider, err := GetPaymentProvider(workspace)
+	if err != nil {
+		return err
+	}
+	result, err := provider.Charge(user, workspace, &ChargeReq{Cents: cents, Description: desc})
+	if err != nil {
+		return err
+	}
+	switch result.Status {
+	case PaymentRequiresAction:
+		return ErrPaymentRequiresAction
+	case PaymentDeclined:
+		return fmt.Errorf("%w: %s", ErrPaymentDeclined, result.DeclineCode)
+	}
+	return nil
+}
+
+func paymentResultFromIntent(intent *stripe.PaymentIntent) *PaymentResult {
+	result := &PaymentResult{PaymentIntentId: intent.ID}
+	switch intent.Status {
+	case stripe.PaymentIntentStatusSucceeded:
+		result.Status = PaymentSucceeded
+	case stripe.PaymentIntentStatusProcessing:
+		result.Status = PaymentPending
+	case stripe.PaymentIntentStatusRequiresAction, stripe.PaymentIntentStatusRequiresConfirmation:
+		result.Status = PaymentRequiresAction
+		result.ClientSecret = intent.ClientSecret
+	default:
+		result.Status = PaymentDeclined
+		if intent.LastPaymentError != nil {
+			result.DeclineCode = string(intent.LastPaymentError.DeclineCode)
+			result.Message = intent.LastPaymentError.Msg
+		}
+	}
+	return result
+}
+
+func paymentResultFromError(err error) (*PaymentResult, error) {
+	stripeErr, ok := err.(*stripe.Error)
+	if !ok {
+		return nil, err
+	}
+	result := &PaymentResult{Message: stripeErr.Msg, DeclineCode: string(stripeErr.DeclineCode)}
+	if stripeErr.PaymentIntent != nil {
+		result.PaymentIntentId = stripeErr.PaymentIntent.ID
+	}
+	if stripeErr.Code == stripe.ErrorCodeAuthenticationRequired {
+		result.Status = PaymentRequiresAction
+		if stripeErr.PaymentIntent != nil {
+			result.ClientSecret = stripeErr.PaymentIntent.ClientSecret
+		}
+		return result, nil
+	}
+	if stripeErr.Type == stripe.ErrorTypeCard {
+		result.Status = PaymentDeclined
+		if result.DeclineCode == "" {
+			result.DeclineCode = string(stripeErr.Code)
+		}
+		return result, nil
+	}
+	return nil, err
+}
@@ -0,0 +1,355 @@
+package helpers
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type PaypalConfig struct {
+	ClientId     string
+	ClientSecret string
+	BaseUrl      string
+}
+
+type paypalLink struct {
+	Href string `json:"href"`
+	Rel  string `json:"rel"`
+}
+
+type paypalErrorDetail struct {
+	Issue       string `json:"issue"`
+	Description string `json:"description"`
+}
+
+type paypalError struct {
+	StatusCode int
+	Name       string              `json:"name"`
+	Message    string              `json:"message"`
+	Details    []paypalErrorDetail `json:"details"`
+}
+
+func (e *paypalError) Error() string {
+	return fmt.Sprintf("paypal error %d %s: %s", e.StatusCode, e.Name, e.Message)
+}
+
+func GetPaypalConfig() *PaypalConfig {
+	baseUrl := "https://api-m.sandbox.paypal.com"
+	if os.Getenv("PAYPAL_MODE") == "live" {
+		baseUrl = "https://api-m.paypal.com"
+	}
+	return &PaypalConfig{
+		ClientId:     os.Getenv("PAYPAL_CLIENT_ID"),
+		ClientSecret: os.Getenv("PAYPAL_CLIENT_SECRET"),
+		BaseUrl:      baseUrl,
+	}
+}
+
+type PaypalProvider struct {
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time
+	clientOnce  sync.Once
+	httpClient  *http.Client
+}
+
+func (p *PaypalProvider) Name() string {
+	return PaymentProviderPaypal
+}
+
+func (p *PaypalProvider) client() *http.Client {
+	p.clientOnce.Do(func() {
+		if p.httpClient == nil {
+			p.httpClient = &http.Client{Timeout: 30 * time.Second}
+		}
+	})
+	return p.httpClient
+}
+
+func (p *PaypalProvider) accessToken(config *PaypalConfig) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.token != "" && time.Now().Before(p.tokenExpiry) {
+		return p.token, nil
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	req, err := http.NewRequest("POST", config.BaseUrl+"/v1/oauth2/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(config.ClientId, config.ClientSecret)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, err := p.client().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("paypal token request failed with status %d", res.StatusCode)
+	}
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&body)
+	if err != nil {
+		return "", err
+	}
+	p.token = body.AccessToken
+	// refresh a minute early so in-flight requests don't use an expired token
+	p.tokenExpiry = time.Now().Add(time.Duration(body.ExpiresIn)*time.Second - time.Minute)
+	return p.token, nil
+}
+
+func (p *PaypalProvider) do(method string, path string, payload interface{}, requestId string, out interface{}) error {
+	config := GetPaypalConfig()
+	token, err := p.accessToken(config)
+	if err != nil {
+		return err
+	}
+
+	var body []byte
+	if payload != nil {
+		body, err = json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, config.BaseUrl+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	if requestId != "" {
+		// paypal's idempotency header
+		req.Header.Set("PayPal-Request-Id", requestId)
+	}
+	res, err := p.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode >= 300 {
+		perr := &paypalError{StatusCode: res.StatusCode}
+		json.Unmarshal(data, perr)
+		return perr
+	}
+	if out != nil && len(data) > 0 {
+		return json.Unmarshal(data, out)
+	}
+	return nil
+}
+
+func (p *PaypalProvider) CreateSubscription(user *User, workspace *Workspace, plan *ServicePlan, cycle string, attempt string) (*ProviderSubscription, error) {
+	planId, err := getProviderPlanId(plan, cycle, plan.PaypalPlanId, plan.PaypalAnnualPlanId)
+	if err != nil {
+		return nil, err
+	}
+	payload := map[string]interface{}{
+		"plan_id":   planId,
+		"custom_id": strconv.Itoa(workspace.Id),
+		"subscriber": map[string]interface{}{
+			"email_address": user.Email,
+			"name": map[string]string{
+				"given_name": user.FirstName,
+				"surname":    user.LastName,
+			},
+		},
+	}
+	var res struct {
+		Id     string       `json:"id"`
+		Status string       `json:"status"`
+		Links  []paypalLink `json:"links"`
+	}
+	requestId := CreatePaymentIdempotencyKey(workspace.Id, "subscription", plan.KeyName+"_"+cycle+"_"+attempt)
+	err = p.do("POST", "/v1/billing/subscriptions", payload, requestId, &res)
+	if err != nil {
+		return nil, err
+	}
+	return &ProviderSubscription{Id: res.Id, Status: strings.ToLower(res.Status), PlanId: planId, ApprovalUrl: paypalApprovalUrl(res.Links)}, nil
+}
+
+func paypalApprovalUrl(links []paypalLink) string {
+	for _, link := range links {
+		if link.Rel == "approve" {
+			return link.Href
+		}
+	}
+	return ""
+}
+
+// ChangeSubscription revises the plan. paypal only applies the revision once the
+// payer follows the returned ApprovalUrl.
+func (p *PaypalProvider) ChangeSubscription(sub *Subscription, plan *ServicePlan, cycle string) (*ProviderSubscription, error) {
+	if sub.ProviderSubscriptionId == nil {
+		return nil, errors.New("subscription has no provider subscription")
+	}
+	planId, err := getProviderPlanId(plan, cycle, plan.PaypalPlanId, plan.PaypalAnnualPlanId)
+	if err != nil {
+		return nil, err
+	}
+	payload := map[string]string{"plan_id": planId}
+	var res struct {
+		PlanId string       `json:"plan_id"`
+		Links  []paypalLink `json:"links"`
+	}
+	err = p.do("POST", "/v1/billing/subscriptions/"+*sub.ProviderSubscriptionId+"/revise", payload, "", &res)
+	if err != nil {
+		return nil, err
+	}
+	result := &ProviderSubscription{Id: *sub.ProviderSubscriptionId, PlanId: planId, ApprovalUrl: paypalApprovalUrl(res.Links)}
+	if result.ApprovalUrl != "" {
+		result.Status = "approval_pending"
+	}
+	return result, nil
+}
+
+// CancelSubscription cancels immediately. paypal has no cancel at period end, so
+// atPeriodEnd returns ErrCancelAtPeriodEndUnsupported and ApplyScheduledChanges
+// cancels once the period is over.
+func (p *PaypalProvider) CancelSubscription(sub *Subscription, atPeriodEnd bool) error {
+	if sub.ProviderSubscriptionId == nil {
+		return errors.New("subscription has no provider subscription")
+	}
+	if atPeriodEnd {
+		return ErrCancelAtPeriodEndUnsupported
+	}
+	payload := map[string]string{"reason": "Cancelled by customer"}
+	return p.do("POST", "/v1/billing/subscriptions/"+*sub.ProviderSubscriptionId+"/cancel", payload, "", nil)
+}
+
+// ResumeSubscription is a no-op since CancelSubscription never cancels paypal subscriptions at period end
+func (p *PaypalProvider) ResumeSubscription(sub *Subscription) error {
+	return nil
+}
+
+type PaypalWebhookEvent struct {
+	Id        string `json:"id"`
+	EventType string `json:"event_type"`
+	Resource  struct {
+		Id     string `json:"id"`
+		PlanId string `json:"plan_id"`
+		Status string `json:"status"`
+	} `json:"resource"`
+}
+
+// VerifyWebhook asks paypal whether payload was signed for the webhook in PAYPAL_WEBHOOK_ID
+func (p *PaypalProvider) VerifyWebhook(header http.Header, payload []byte) error {
+	webhookId := os.Getenv("PAYPAL_WEBHOOK_ID")
+	if webhookId == "" {
+		return errors.New("PAYPAL_WEBHOOK_ID is not set")
+	}
+	body := map[string]interface{}{
+		"auth_algo":         header.Get("Paypal-Auth-Algo"),
+		"cert_url":          header.Get("Paypal-Cert-Url"),
+		"transmission_id":   header.Get("Paypal-Transmission-Id"),
+		"transmission_sig":  header.Get("Paypal-Transmission-Sig"),
+		"transmission_time": header.Get("Paypal-Transmission-Time"),
+		"webhook_id":        webhookId,
+		"webhook_event":     json.RawMessage(payload),
+	}
+	var res struct {
+		VerificationStatus string `json:"verification_status"`
+	}
+	err := p.do("POST", "/v1/notifications/verify-webhook-signature", body, "", &res)
+	if err != nil {
+		return err
+	}
+	if res.VerificationStatus != "SUCCESS" {
+		return fmt.Errorf("paypal webhook verification returned %s", res.VerificationStatus)
+	}
+	return nil
+}
+
+func GetPaypalVaultId(workspaceId int) (string, error) {
+	var vaultId string
+	row := db.QueryRow("SELECT vault_id FROM paypal_vaults WHERE workspace_id = ? AND `primary` = 1", workspaceId)
+	err := row.Scan(&vaultId)
+	if err == sql.ErrNoRows {
+		return "", ErrNoPaymentMethod
+	}
+	if err != nil {
+		return "", err
+	}
+	return vaultId, nil
+}
+
+func (p *PaypalProvider) Charge(user *User, workspace *Workspace, req *ChargeReq) (*PaymentResult, error) {
+	vaultId, err := GetPaypalVaultId(workspace.Id)
+	if err != nil {
+		return nil, err
+	}
+	payload := map[string]interface{}{
+		"intent": "CAPTURE",
+		"purchase_units": []map[string]interface{}{
+			{
+				"description": req.Description,
+				"custom_id":   strconv.Itoa(workspace.Id),
+				"amount": map[string]string{
+					"currency_code": "USD",
+					"value":         fmt.Sprintf("%d.%02d", req.Cents/100, req.Cents%100),
+				},
+			},
+		},
+		"payment_source": map[string]interface{}{
+			"paypal": map[string]string{"vault_id": vaultId},
+		},
+	}
+	key := req.IdempotencyKey
+	if key == "" {
+		key = CreateAPIID("charge")
+	}
+
+	var res struct {
+		Id     string       `json:"id"`
+		Status string       `json:"status"`
+		Links  []paypalLink `json:"links"`
+	}
+	err = p.do("POST", "/v2/checkout/orders", payload, key, &res)
+	if err != nil {
+		perr, ok := err.(*paypalError)
+		if !ok || perr.StatusCode != http.StatusUnprocessableEntity {
+			return nil, err
+		}
+		result := &PaymentResult{Status: PaymentDeclined, Message: perr.Message}
+		if len(perr.Details) > 0 {
+			result.DeclineCode = strings.ToLower(perr.Details[0].Issue)
+		}
+		return result, nil
+	}
+
+	result := &PaymentResult{PaymentIntentId: res.Id}
+	switch res.Status {
+	case "COMPLETED":
+		result.Status = PaymentSucceeded
+	case "PAYER_ACTION_REQUIRED":
+		result.Status = PaymentRequiresAction
+		for _, link := range res.Links {
+			if link.Rel == "payer-action" {
+				result.ActionUrl = link.Href
+			}
+		}
+	default:
+		result.Status = PaymentDeclined
+		result.Message = "order status " + res.Status
+	}
+	return result, nil
+}
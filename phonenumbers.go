@@ -0,0 +1,177 @@
+package helpers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/ttacon/libphonenumber"
+)
+
+type NumberType string
+
+const (
+	NumberTypeMobile         NumberType = "mobile"
+	NumberTypeLandline       NumberType = "landline"
+	NumberTypeLandlineMobile NumberType = "landline_or_mobile"
+	NumberTypeTollFree       NumberType = "toll_free"
+	NumberTypePremium        NumberType = "premium"
+	NumberTypeSharedCost     NumberType = "shared_cost"
+	NumberTypeVoip           NumberType = "voip"
+	NumberTypeOther          NumberType = "other"
+	NumberTypeUnknown        NumberType = "unknown"
+)
+
+// FallbackPhoneRegion is used when neither DEFAULT_PHONE_REGION nor the workspace's
+// billing country give a region
+const FallbackPhoneRegion = "US"
+
+var ErrInvalidPhoneNumber = errors.New("invalid phone number")
+
+// call control codes dialled ahead of the number, e.g. caller id blocking
+var diallingPrefixes = []string{"*67", "*82", "#31#", "*31#"}
+
+type PhoneNumber struct {
+	Raw         string                      `json:"raw"`
+	E164        string                      `json:"e164"`
+	National    string                      `json:"national"`
+	CountryCode int                         `json:"country_code"`
+	Region      string                      `json:"region"`
+	Type        NumberType                  `json:"type"`
+	Valid       bool                        `json:"valid"`
+	Parsed      *libphonenumber.PhoneNumber `json:"-"`
+}
+
+var numberTypes = map[libphonenumber.PhoneNumberType]NumberType{
+	libphonenumber.MOBILE:               NumberTypeMobile,
+	libphonenumber.FIXED_LINE:           NumberTypeLandline,
+	libphonenumber.FIXED_LINE_OR_MOBILE: NumberTypeLandlineMobile,
+	libphonenumber.TOLL_FREE:            NumberTypeTollFree,
+	libphonenumber.PREMIUM_RATE:         NumberTypePremium,
+	libphonenumber.SHARED_COST:          NumberTypeSharedCost,
+	libphonenumber.VOIP:                 NumberTypeVoip,
+	libphonenumber.PERSONAL_NUMBER:      NumberTypeOther,
+	libphonenumber.PAGER:                NumberTypeOther,
+	libphonenumber.UAN:                  NumberTypeOther,
+	libphonenumber.VOICEMAIL:            NumberTypeOther,
+}
+
+// ExtractNumber pulls the dialled number out of SIP URIs, tel: URIs and name-addr
+// headers like "Alice" <sip:+15551234567@host;user=phone>
+func ExtractNumber(input string) string {
+	value := strings.TrimSpace(input)
+	if start := strings.Index(value, "<"); start != -1 {
+		if end := strings.Index(value[start:], ">"); end != -1 {
+			value = value[start+1 : start+end]
+		}
+	}
+	lower := strings.ToLower(value)
+	for _, scheme := range []string{"sips:", "sip:", "tel:"} {
+		if strings.HasPrefix(lower, scheme) {
+			value = value[len(scheme):]
+			break
+		}
+	}
+	if idx := strings.Index(value, "@"); idx != -1 {
+		value = value[:idx]
+	}
+	if idx := strings.Index(value, ";"); idx != -1 {
+		value = value[:idx]
+	}
+	for _, prefix := range diallingPrefixes {
+		value = strings.TrimPrefix(value, prefix)
+	}
+	return strings.TrimSpace(value)
+}
+
+func GetDefaultPhoneRegion() string {
+	if val := os.Getenv("DEFAULT_PHONE_REGION"); val != "" {
+		return strings.ToUpper(val)
+	}
+	return FallbackPhoneRegion
+}
+
+// NormalizeNumber parses input as dialled in region. numbers with a + or an
+// international dialling prefix keep their own country.
+func NormalizeNumber(input string, region string) (*PhoneNumber, error) {
+	if region == "" {
+		region = GetDefaultPhoneRegion()
+	}
+	raw := ExtractNumber(input)
+	if raw == "" {
+		return nil, ErrInvalidPhoneNumber
+	}
+	num, err := libphonenumber.Parse(raw, strings.ToUpper(region))
+	if err != nil {
+		return nil, err
+	}
+	value := &PhoneNumber{
+		Raw:         input,
+		E164:        libphonenumber.Format(num, libphonenumber.E164),
+		National:    libphonenumber.Format(num, libphonenumber.NATIONAL),
+		CountryCode: int(num.GetCountryCode()),
+		Region:      libphonenumber.GetRegionCodeForNumber(num),
+		Valid:       libphonenumber.IsValidNumber(num),
+		Type:        NumberTypeUnknown,
+		Parsed:      num,
+	}
+	if numberType, ok := numberTypes[libphonenumber.GetNumberType(num)]; ok {
+		value.Type = numberType
+	}
+	return value, nil
+}
+
+var countryRegionCache = struct {
+	sync.RWMutex
+	regions map[int]string
+}{regions: make(map[int]string)}
+
+// GetCountryRegion returns the ISO 3166 code for a countries row
+func GetCountryRegion(countryId int) (string, error) {
+	countryRegionCache.RLock()
+	region, ok := countryRegionCache.regions[countryId]
+	countryRegionCache.RUnlock()
+	if ok {
+		return region, nil
+	}
+	err := db.QueryRow("SELECT iso FROM countries WHERE id = ?", countryId).Scan(&region)
+	if err != nil {
+		return "", err
+	}
+	region = strings.ToUpper(region)
+	countryRegionCache.Lock()
+	countryRegionCache.regions[countryId] = region
+	countryRegionCache.Unlock()
+	return region, nil
+}
+
+// GetWorkspacePhoneRegion picks the default region for numbers dialled by the workspace
+// from its billing country
+func GetWorkspacePhoneRegion(workspace *Workspace) string {
+	if workspace == nil || workspace.BillingCountryId == 0 {
+		return GetDefaultPhoneRegion()
+	}
+	region, err := GetCountryRegion(workspace.BillingCountryId)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			fmt.Printf("could not get region for country %d: %v\r\n", workspace.BillingCountryId, err)
+		}
+		return GetDefaultPhoneRegion()
+	}
+	return region
+}
+
+func GetWorkspacePhoneRegionById(workspaceId int) string {
+	workspace, err := GetWorkspaceFromDB(workspaceId)
+	if err != nil {
+		return GetDefaultPhoneRegion()
+	}
+	return GetWorkspacePhoneRegion(workspace)
+}
+
+func NormalizeWorkspaceNumber(workspace *Workspace, input string) (*PhoneNumber, error) {
+	return NormalizeNumber(input, GetWorkspacePhoneRegion(workspace))
+}
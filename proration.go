@@ -0,0 +1,174 @@
+package helpers
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// ProrationImmediate switches plans at the change time and prorates the rest of the period
+	ProrationImmediate = "immediate"
+	// ProrationEndOfPeriod switches plans when the current period ends, nothing is prorated
+	ProrationEndOfPeriod = "end_of_period"
+)
+
+const (
+	// AnnualToMonthlyDefer keeps the annual plan until its term ends, then bills monthly
+	AnnualToMonthlyDefer = "defer"
+	// AnnualToMonthlyCredit credits the unused annual term and starts billing monthly right away
+	AnnualToMonthlyCredit = "credit"
+)
+
+const (
+	ProrationLineCredit = "credit"
+	ProrationLineCharge = "charge"
+)
+
+type ProrationReq struct {
+	Subscription *Subscription
+	OldPlan      *ServicePlan
+	NewPlan      *ServicePlan
+	// NewCycle defaults to the subscription's current billing cycle
+	NewCycle              string
+	ChangeAt              time.Time
+	Policy                string
+	AnnualToMonthlyPolicy string
+}
+
+type ProrationLineItem struct {
+	Kind        string    `json:"kind"`
+	Description string    `json:"description"`
+	PlanId      int       `json:"plan_id"`
+	Cycle       string    `json:"cycle"`
+	Cents       int       `json:"cents"`
+	PeriodStart time.Time `json:"period_start"`
+	PeriodEnd   time.Time `json:"period_end"`
+	Seconds     int64     `json:"seconds"`
+}
+
+type ProrationResult struct {
+	Policy       string              `json:"policy"`
+	EffectiveAt  time.Time           `json:"effective_at"`
+	NewPeriodEnd time.Time           `json:"new_period_end"`
+	Items        []ProrationLineItem `json:"items"`
+	ChargeCents  int                 `json:"charge_cents"`
+	CreditCents  int                 `json:"credit_cents"`
+	// NetCents is what the customer owes now, negative when they are owed credit
+	NetCents int `json:"net_cents"`
+}
+
+// addMonths moves t by months keeping the time of day. days past the end of the
+// target month fall on its last day, like anchorDate, so Jan 31 + 1 is Feb 28.
+func addMonths(t time.Time, months int) time.Time {
+	first := time.Date(t.Year(), t.Month()+time.Month(months), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	day := t.Day()
+	if lastDay := first.AddDate(0, 1, -1).Day(); day > lastDay {
+		day = lastDay
+	}
+	return first.AddDate(0, 0, day-1)
+}
+
+func subtractBillingCycle(end time.Time, cycle string) time.Time {
+	if cycle == BillingCycleAnnual {
+		return addMonths(end, -12)
+	}
+	return addMonths(end, -1)
+}
+
+// prorateCents returns cents * part / whole rounded to the nearest cent
+func prorateCents(cents int, part int64, whole int64) int {
+	if whole <= 0 || part <= 0 {
+		return 0
+	}
+	if part >= whole {
+		return cents
+	}
+	return int((int64(cents)*part*2 + whole) / (whole * 2))
+}
+
+// CalculateProration works out the credit for unused time on the old plan and the
+// charge for the new plan when a subscription changes mid-cycle.
+func CalculateProration(req *ProrationReq) (*ProrationResult, error) {
+	sub := req.Subscription
+	if sub == nil || req.OldPlan == nil || req.NewPlan == nil {
+		return nil, errors.New("proration needs a subscription, old plan and new plan")
+	}
+	oldCycle := sub.BillingCycle
+	if oldCycle == "" {
+		oldCycle = BillingCycleMonthly
+	}
+	newCycle := req.NewCycle
+	if newCycle == "" {
+		newCycle = oldCycle
+	}
+	policy := req.Policy
+	if policy == "" {
+		policy = ProrationImmediate
+	}
+
+	periodEnd := sub.CurrentPeriodEnd
+	periodStart := subtractBillingCycle(periodEnd, oldCycle)
+	changeAt := req.ChangeAt.Truncate(time.Second)
+	if changeAt.Before(periodStart) || changeAt.After(periodEnd) {
+		return nil, fmt.Errorf("change time %s is outside the current period %s - %s", changeAt, periodStart, periodEnd)
+	}
+
+	if oldCycle == BillingCycleAnnual && newCycle == BillingCycleMonthly && req.AnnualToMonthlyPolicy != AnnualToMonthlyCredit {
+		policy = ProrationEndOfPeriod
+	}
+	result := &ProrationResult{Policy: policy, Items: make([]ProrationLineItem, 0)}
+	if policy == ProrationEndOfPeriod {
+		result.EffectiveAt = periodEnd
+		result.NewPeriodEnd = addBillingCycle(periodEnd, newCycle)
+		return result, nil
+	}
+	if policy != ProrationImmediate {
+		return nil, fmt.Errorf("unknown proration policy %s", policy)
+	}
+
+	result.EffectiveAt = changeAt
+	periodSeconds := int64(periodEnd.Sub(periodStart) / time.Second)
+	remainingSeconds := int64(periodEnd.Sub(changeAt) / time.Second)
+
+	credit := prorateCents(planPriceCents(req.OldPlan, oldCycle), remainingSeconds, periodSeconds)
+	if credit > 0 {
+		result.Items = append(result.Items, ProrationLineItem{
+			Kind:        ProrationLineCredit,
+			Description: fmt.Sprintf("Unused time on %s", req.OldPlan.NiceName),
+			PlanId:      req.OldPlan.Id,
+			Cycle:       oldCycle,
+			Cents:       credit,
+			PeriodStart: changeAt,
+			PeriodEnd:   periodEnd,
+			Seconds:     remainingSeconds,
+		})
+	}
+
+	var charge int
+	var item ProrationLineItem
+	if newCycle == oldCycle {
+		// same cycle, the new plan runs for what is left of the current period
+		result.NewPeriodEnd = periodEnd
+		charge = prorateCents(planPriceCents(req.NewPlan, newCycle), remainingSeconds, periodSeconds)
+		item = ProrationLineItem{PeriodStart: changeAt, PeriodEnd: periodEnd, Seconds: remainingSeconds}
+	} else {
+		// the cycle changes so a full new period starts now
+		result.NewPeriodEnd = addBillingCycle(changeAt, newCycle)
+		charge = planPriceCents(req.NewPlan, newCycle)
+		item = ProrationLineItem{PeriodStart: changeAt, PeriodEnd: result.NewPeriodEnd, Seconds: int64(result.NewPeriodEnd.Sub(changeAt) / time.Second)}
+	}
+	if charge > 0 {
+		item.Kind = ProrationLineCharge
+		item.Description = fmt.Sprintf("Remaining time on %s", req.NewPlan.NiceName)
+		item.PlanId = req.NewPlan.Id
+		item.Cycle = newCycle
+		item.Cents = charge
+		result.Items = append(result.Items, item)
+	}
+
+	result.CreditCents = credit
+	result.ChargeCents = charge
+	result.NetCents = charge - credit
+	return result, nil
+}
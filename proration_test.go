@@ -0,0 +1,146 @@
+package helpers
+
+import (
+	"testing"
+	"time"
+)
+
+func testPlan(id int, monthlyCents int, annualCents int) *ServicePlan {
+	return &ServicePlan{Id: id, NiceName: "plan", MonthlyCostCents: monthlyCents, AnnualCostCents: annualCents}
+}
+
+func TestAddBillingCycle(t *testing.T) {
+	tests := []struct {
+		name  string
+		start time.Time
+		cycle string
+		want  time.Time
+	}{
+		{"mid month", time.Date(2023, 3, 15, 10, 0, 0, 0, time.UTC), BillingCycleMonthly, time.Date(2023, 4, 15, 10, 0, 0, 0, time.UTC)},
+		{"jan 31 to feb", time.Date(2023, 1, 31, 0, 0, 0, 0, time.UTC), BillingCycleMonthly, time.Date(2023, 2, 28, 0, 0, 0, 0, time.UTC)},
+		{"jan 31 to leap feb", time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC), BillingCycleMonthly, time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"december to january", time.Date(2023, 12, 31, 0, 0, 0, 0, time.UTC), BillingCycleMonthly, time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC)},
+		{"annual from leap day", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC), BillingCycleAnnual, time.Date(2025, 2, 28, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := addBillingCycle(tt.start, tt.cycle); !got.Equal(tt.want) {
+				t.Fatalf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSubtractBillingCycle(t *testing.T) {
+	end := time.Date(2023, 3, 31, 0, 0, 0, 0, time.UTC)
+	want := time.Date(2023, 2, 28, 0, 0, 0, 0, time.UTC)
+	if got := subtractBillingCycle(end, BillingCycleMonthly); !got.Equal(want) {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+}
+
+func TestCalculateProration(t *testing.T) {
+	tests := []struct {
+		name         string
+		cycle        string
+		periodEnd    time.Time
+		changeAt     time.Time
+		oldPlan      *ServicePlan
+		newPlan      *ServicePlan
+		newCycle     string
+		annualPolicy string
+		wantErr      bool
+		wantPolicy   string
+		wantCredit   int
+		wantCharge   int
+		wantNet      int
+		wantPeriod   time.Time
+	}{
+		{
+			name:       "mid period upgrade",
+			cycle:      BillingCycleMonthly,
+			periodEnd:  time.Date(2023, 4, 15, 0, 0, 0, 0, time.UTC),
+			changeAt:   time.Date(2023, 3, 30, 0, 0, 0, 0, time.UTC),
+			oldPlan:    testPlan(1, 3100, 0),
+			newPlan:    testPlan(2, 6200, 0),
+			wantPolicy: ProrationImmediate,
+			wantCredit: 1600,
+			wantCharge: 3200,
+			wantNet:    1600,
+			wantPeriod: time.Date(2023, 4, 15, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:       "period ending on the 31st starts on the last day of february",
+			cycle:      BillingCycleMonthly,
+			periodEnd:  time.Date(2023, 3, 31, 0, 0, 0, 0, time.UTC),
+			changeAt:   time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC),
+			oldPlan:    testPlan(1, 3100, 0),
+			newPlan:    testPlan(2, 6200, 0),
+			wantPolicy: ProrationImmediate,
+			wantCredit: 2950,
+			wantCharge: 5900,
+			wantNet:    2950,
+			wantPeriod: time.Date(2023, 3, 31, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "change before the period started",
+			cycle:     BillingCycleMonthly,
+			periodEnd: time.Date(2023, 3, 31, 0, 0, 0, 0, time.UTC),
+			changeAt:  time.Date(2023, 2, 27, 0, 0, 0, 0, time.UTC),
+			oldPlan:   testPlan(1, 3100, 0),
+			newPlan:   testPlan(2, 6200, 0),
+			wantErr:   true,
+		},
+		{
+			name:       "annual to monthly waits for the term to end",
+			cycle:      BillingCycleAnnual,
+			periodEnd:  time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC),
+			changeAt:   time.Date(2023, 7, 2, 0, 0, 0, 0, time.UTC),
+			oldPlan:    testPlan(1, 1000, 36500),
+			newPlan:    testPlan(2, 1000, 36500),
+			newCycle:   BillingCycleMonthly,
+			wantPolicy: ProrationEndOfPeriod,
+			wantPeriod: time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:         "annual to monthly with credit",
+			cycle:        BillingCycleAnnual,
+			periodEnd:    time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			changeAt:     time.Date(2023, 7, 2, 0, 0, 0, 0, time.UTC),
+			oldPlan:      testPlan(1, 1000, 36500),
+			newPlan:      testPlan(2, 1000, 36500),
+			newCycle:     BillingCycleMonthly,
+			annualPolicy: AnnualToMonthlyCredit,
+			wantPolicy:   ProrationImmediate,
+			wantCredit:   18300,
+			wantCharge:   1000,
+			wantNet:      -17300,
+			wantPeriod:   time.Date(2023, 8, 2, 0, 0, 0, 0, time.UTC),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sub := &Subscription{BillingCycle: tt.cycle, CurrentPeriodEnd: tt.periodEnd}
+			result, err := CalculateProration(&ProrationReq{Subscription: sub, OldPlan: tt.oldPlan, NewPlan: tt.newPlan, NewCycle: tt.newCycle,
+				ChangeAt: tt.changeAt, AnnualToMonthlyPolicy: tt.annualPolicy})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", result)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Policy != tt.wantPolicy {
+				t.Fatalf("expected policy %s, got %s", tt.wantPolicy, result.Policy)
+			}
+			if result.CreditCents != tt.wantCredit || result.ChargeCents != tt.wantCharge || result.NetCents != tt.wantNet {
+				t.Fatalf("expected credit %d charge %d net %d, got %d %d %d", tt.wantCredit, tt.wantCharge, tt.wantNet, result.CreditCents, result.ChargeCents, result.NetCents)
+			}
+			if !result.NewPeriodEnd.Equal(tt.wantPeriod) {
+				t.Fatalf("expected the new period to end %s, got %s", tt.wantPeriod, result.NewPeriodEnd)
+			}
+		})
+	}
+}
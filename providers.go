@@ -0,0 +1,272 @@
+package helpers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/stripe/stripe-go/v71"
+)
+
+const (
+	BillingCycleMonthly = "monthly"
+	BillingCycleAnnual  = "annual"
+)
+
+const (
+	PaymentProviderStripe = "stripe"
+	PaymentProviderPaypal = "paypal"
+)
+
+type ProviderSubscription struct {
+	Id     string `json:"id"`
+	Status string `json:"status"`
+	// PlanId is the provider's id for the plan the subscription is on or moving to
+	PlanId string `json:"plan_id"`
+	// ApprovalUrl is set when the customer has to approve the subscription with the provider
+	ApprovalUrl string `json:"approval_url"`
+}
+
+// ErrCancelAtPeriodEndUnsupported is returned by providers that can only cancel
+// immediately, the caller has to cancel once the period is over
+var ErrCancelAtPeriodEndUnsupported = errors.New("provider cannot cancel at period end")
+
+type PaymentProvider interface {
+	Name() string
+	// CreateSubscription uses attempt for idempotency, retries of one attempt must pass the
+	// same value and a new attempt, e.g. resubscribing after a cancel, a different one
+	CreateSubscription(user *User, workspace *Workspace, plan *ServicePlan, cycle string, attempt string) (*ProviderSubscription, error)
+	// ChangeSubscription returns the changed subscription, its ApprovalUrl is set when the
+	// payer has to approve the change before it takes effect
+	ChangeSubscription(sub *Subscription, plan *ServicePlan, cycle string) (*ProviderSubscription, error)
+	CancelSubscription(sub *Subscription, atPeriodEnd bool) error
+	// ResumeSubscription undoes a pending cancel at period end
+	ResumeSubscription(sub *Subscription) error
+	Charge(user *User, workspace *Workspace, req *ChargeReq) (*PaymentResult, error)
+}
+
+var paymentProvidersMu sync.RWMutex
+var paymentProviders = map[string]PaymentProvider{
+	PaymentProviderStripe: &StripeProvider{},
+	PaymentProviderPaypal: &PaypalProvider{},
+}
+
+// RegisterPaymentProvider adds or replaces a provider, e.g. a FakePaymentProvider in tests
+func RegisterPaymentProvider(name string, provider PaymentProvider) {
+	paymentProvidersMu.Lock()
+	defer paymentProvidersMu.Unlock()
+	paymentProviders[name] = provider
+}
+
+func GetPaymentProviderByName(name string) (PaymentProvider, error) {
+	paymentProvidersMu.RLock()
+	defer paymentProvidersMu.RUnlock()
+	provider, ok := paymentProviders[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown payment provider %s", name)
+	}
+	return provider, nil
+}
+
+// GetPaymentProvider returns the provider the workspace is billed through, defaulting to stripe
+func GetPaymentProvider(workspace *Workspace) (PaymentProvider, error) {
+	var name sql.NullString
+	row := db.QueryRow("SELECT payment_provider FROM subscriptions WHERE workspace_id = ?", workspace.Id)
+	err := row.Scan(&name)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if !name.Valid || name.String == "" {
+		return GetPaymentProviderByName(PaymentProviderStripe)
+	}
+	return GetPaymentProviderByName(name.String)
+}
+
+func getProviderPlanId(plan *ServicePlan, cycle string, monthly *string, annual *string) (string, error) {
+	id := monthly
+	if cycle == BillingCycleAnnual {
+		id = annual
+	}
+	if id == nil || *id == "" {
+		return "", fmt.Errorf("plan %s has no %s provider plan", plan.KeyName, cycle)
+	}
+	return *id, nil
+}
+
+type StripeProvider struct {
+}
+
+func (p *StripeProvider) Name() string {
+	return PaymentProviderStripe
+}
+
+func (p *StripeProvider) CreateSubscription(user *User, workspace *Workspace, plan *ServicePlan, cycle string, attempt string) (*ProviderSubscription, error) {
+	if user.StripeId == "" {
+		return nil, fmt.Errorf("user %d has no stripe customer", user.Id)
+	}
+	priceId, err := getProviderPlanId(plan, cycle, plan.StripePlanId, plan.StripeAnnualPlanId)
+	if err != nil {
+		return nil, err
+	}
+	sc, err := CreateStripeClient()
+	if err != nil {
+		return nil, err
+	}
+	method, err := GetPrimaryPaymentMethod(workspace.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	params := &stripe.SubscriptionParams{
+		Customer:             stripe.String(user.StripeId),
+		DefaultPaymentMethod: stripe.String(method.StripeId),
+		Items: []*stripe.SubscriptionItemsParams{
+			{Price: stripe.String(priceId)},
+		},
+	}
+	params.AddMetadata("workspace_id", strconv.Itoa(workspace.Id))
+	params.SetIdempotencyKey(CreatePaymentIdempotencyKey(workspace.Id, "subscription", plan.KeyName+"_"+cycle+"_"+attempt))
+	sub, err := sc.Subscriptions.New(params)
+	if err != nil {
+		return nil, err
+	}
+	return &ProviderSubscription{Id: sub.ID, Status: string(sub.Status), PlanId: priceId}, nil
+}
+
+func (p *StripeProvider) ChangeSubscription(sub *Subscription, plan *ServicePlan, cycle string) (*ProviderSubscription, error) {
+	if sub.ProviderSubscriptionId == nil {
+		return nil, errors.New("subscription has no provider subscription")
+	}
+	priceId, err := getProviderPlanId(plan, cycle, plan.StripePlanId, plan.StripeAnnualPlanId)
+	if err != nil {
+		return nil, err
+	}
+	sc, err := CreateStripeClient()
+	if err != nil {
+		return nil, err
+	}
+	current, err := sc.Subscriptions.Get(*sub.ProviderSubscriptionId, nil)
+	if err != nil {
+		return nil, err
+	}
+	if current.Items == nil || len(current.Items.Data) == 0 {
+		return nil, fmt.Errorf("stripe subscription %s has no items", current.ID)
+	}
+
+	// proration is billed by the caller, stripe just switches the price
+	params := &stripe.SubscriptionParams{
+		ProrationBehavior: stripe.String("none"),
+		Items: []*stripe.SubscriptionItemsParams{
+			{ID: stripe.String(current.Items.Data[0].ID), Price: stripe.String(priceId)},
+		},
+	}
+	updated, err := sc.Subscriptions.Update(current.ID, params)
+	if err != nil {
+		return nil, err
+	}
+	return &ProviderSubscription{Id: updated.ID, Status: string(updated.Status), PlanId: priceId}, nil
+}
+
+func (p *StripeProvider) CancelSubscription(sub *Subscription, atPeriodEnd bool) error {
+	if sub.ProviderSubscriptionId == nil {
+		return errors.New("subscription has no provider subscription")
+	}
+	sc, err := CreateStripeClient()
+	if err != nil {
+		return err
+	}
+	if atPeriodEnd {
+		_, err = sc.Subscriptions.Update(*sub.ProviderSubscriptionId, &stripe.SubscriptionParams{CancelAtPeriodEnd: stripe.Bool(true)})
+		return err
+	}
+	_, err = sc.Subscriptions.Cancel(*sub.ProviderSubscriptionId, nil)
+	return err
+}
+
+func (p *StripeProvider) ResumeSubscription(sub *Subscription) error {
+	if sub.ProviderSubscriptionId == nil {
+		return errors.New("subscription has no provider subscription")
+	}
+	sc, err := CreateStripeClient()
+	if err != nil {
+		return err
+	}
+	_, err = sc.Subscriptions.Update(*sub.ProviderSubscriptionId, &stripe.SubscriptionParams{CancelAtPeriodEnd: stripe.Bool(false)})
+	return err
+}
+
+func (p *StripeProvider) Charge(user *User, workspace *Workspace, req *ChargeReq) (*PaymentResult, error) {
+	return ChargeWorkspace(user, workspace, req)
+}
+
+type FakeProviderCall struct {
+	Method      string
+	WorkspaceId int
+	PlanKey     string
+	Cycle       string
+	Attempt     string
+	Cents       int
+	AtPeriodEnd bool
+}
+
+// FakePaymentProvider records calls instead of talking to a payment service
+type FakePaymentProvider struct {
+	mu           sync.Mutex
+	Calls        []FakeProviderCall
+	ChargeResult *PaymentResult
+	Err          error
+}
+
+func NewFakePaymentProvider() *FakePaymentProvider {
+	return &FakePaymentProvider{ChargeResult: &PaymentResult{Status: PaymentSucceeded}}
+}
+
+func (p *FakePaymentProvider) record(call FakeProviderCall) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Calls = append(p.Calls, call)
+	return p.Err
+}
+
+func (p *FakePaymentProvider) Name() string {
+	return "fake"
+}
+
+func (p *FakePaymentProvider) CreateSubscription(user *User, workspace *Workspace, plan *ServicePlan, cycle string, attempt string) (*ProviderSubscription, error) {
+	err := p.record(FakeProviderCall{Method: "CreateSubscription", WorkspaceId: workspace.Id, PlanKey: plan.KeyName, Cycle: cycle, Attempt: attempt})
+	if err != nil {
+		return nil, err
+	}
+	return &ProviderSubscription{Id: CreateAPIID("fakesub"), Status: "active"}, nil
+}
+
+func (p *FakePaymentProvider) ChangeSubscription(sub *Subscription, plan *ServicePlan, cycle string) (*ProviderSubscription, error) {
+	err := p.record(FakeProviderCall{Method: "ChangeSubscription", WorkspaceId: sub.WorkspaceId, PlanKey: plan.KeyName, Cycle: cycle})
+	if err != nil {
+		return nil, err
+	}
+	id := ""
+	if sub.ProviderSubscriptionId != nil {
+		id = *sub.ProviderSubscriptionId
+	}
+	return &ProviderSubscription{Id: id, Status: "active"}, nil
+}
+
+func (p *FakePaymentProvider) CancelSubscription(sub *Subscription, atPeriodEnd bool) error {
+	return p.record(FakeProviderCall{Method: "CancelSubscription", WorkspaceId: sub.WorkspaceId, AtPeriodEnd: atPeriodEnd})
+}
+
+func (p *FakePaymentProvider) ResumeSubscription(sub *Subscription) error {
+	return p.record(FakeProviderCall{Method: "ResumeSubscription", WorkspaceId: sub.WorkspaceId})
+}
+
+func (p *FakePaymentProvider) Charge(user *User, workspace *Workspace, req *ChargeReq) (*PaymentResult, error) {
+	err := p.record(FakeProviderCall{Method: "Charge", WorkspaceId: workspace.Id, Cents: req.Cents})
+	if err != nil {
+		return nil, err
+	}
+	result := *p.ChargeResult
+	return &result, nil
+}
@@ -0,0 +1,353 @@
+package helpers
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+type QuotaResource string
+
+const (
+	QuotaRecordingBytes  QuotaResource = "recording_bytes"
+	QuotaFaxes           QuotaResource = "faxes"
+	QuotaExtensions      QuotaResource = "extensions"
+	QuotaConcurrentCalls QuotaResource = "concurrent_calls"
+)
+
+const (
+	QuotaLevelOk       = "ok"
+	QuotaLevelWarning  = "warning"
+	QuotaLevelFull     = "full"
+	QuotaLevelExceeded = "exceeded"
+)
+
+// usage percentages that trigger a warning email, once per threshold per month
+var quotaWarningThresholds = []int{80, 100}
+
+const quotaWarningTTL = 31 * 24 * time.Hour
+
+type QuotaDecision struct {
+	Resource  QuotaResource `json:"resource"`
+	Used      int64         `json:"used"`
+	Delta     int64         `json:"delta"`
+	Limit     int64         `json:"limit"`
+	Unlimited bool          `json:"unlimited"`
+	Allowed   bool          `json:"allowed"`
+	Level     string        `json:"level"`
+}
+
+// checks the reservation against the limit and records it in one step. returns
+// {-1, 0} when the counter isn't seeded, {0, used} when denied, {1, total} when reserved
+const reserveQuotaScript = `
+local val = redis.call("get", KEYS[1])
+if not val then return {-1, 0} end
+local used = tonumber(val)
+local limit = tonumber(ARGV[1])
+local delta = tonumber(ARGV[2])
+if limit >= 0 and delta > 0 and used + delta > limit then return {0, used} end
+local total = redis.call("incrby", KEYS[1], delta)
+if tonumber(ARGV[3]) > 0 then redis.call("expireat", KEYS[1], ARGV[3]) end
+return {1, total}`
+
+// keep monthly counters around for a while after the month ends
+const quotaWindowRetention = 7 * 24 * time.Hour
+
+// quotaWindow returns the start and end of the period usage is counted over, zero
+// times for resources that are counted over all time
+func quotaWindow(resource QuotaResource, now time.Time) (time.Time, time.Time) {
+	if resource != QuotaFaxes {
+		return time.Time{}, time.Time{}
+	}
+	now = now.UTC()
+	start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return start, start.AddDate(0, 1, 0)
+}
+
+func quotaKey(workspaceId int, resource QuotaResource, now time.Time) string {
+	start, _ := quotaWindow(resource, now)
+	if start.IsZero() {
+		return fmt.Sprintf("quota:%d:%s", workspaceId, resource)
+	}
+	return fmt.Sprintf("quota:%d:%s:%s", workspaceId, resource, start.Format("200601"))
+}
+
+// quotaExpireAt returns the unix time the counter expires at, 0 when it doesn't
+func quotaExpireAt(resource QuotaResource, now time.Time) int64 {
+	_, end := quotaWindow(resource, now)
+	if end.IsZero() {
+		return 0
+	}
+	return end.Add(quotaWindowRetention).Unix()
+}
+
+// GetQuotaLimit returns the plan limit for resource, unlimited is true when there is none
+func GetQuotaLimit(workspace *Workspace, resource QuotaResource) (int64, bool, error) {
+	entitlements, err := GetEntitlements(workspace)
+	if err != nil {
+		return 0, false, err
+	}
+	limits := entitlements.Limits
+	switch resource {
+	case QuotaRecordingBytes:
+		return int64(limits.RecordingSpaceKb) * 1024, false, nil
+	case QuotaFaxes:
+		return int64(limits.Faxes), limits.UnlimitedFax, nil
+	case QuotaExtensions:
+		return int64(limits.Extensions), limits.UnlimitedExtensions, nil
+	case QuotaConcurrentCalls:
+		// plans without ports configured don't cap concurrent calls
+		return int64(limits.Ports), limits.Ports == 0, nil
+	}
+	return 0, false, fmt.Errorf("unknown quota resource %s", resource)
+}
+
+// CountQuotaUsage reads current usage straight from MySQL, faxes are counted for
+// the current month
+func CountQuotaUsage(workspaceId int, resource QuotaResource, now time.Time) (int64, error) {
+	var query string
+	args := []interface{}{workspaceId}
+	switch resource {
+	case QuotaRecordingBytes:
+		query = "SELECT COALESCE(SUM(size), 0) FROM recordings WHERE workspace_id = ?"
+	case QuotaFaxes:
+		start, end := quotaWindow(resource, now)
+		query = "SELECT COUNT(*) FROM faxes WHERE workspace_id = ? AND created_at >= ? AND created_at < ?"
+		args = append(args, start, end)
+	case QuotaExtensions:
+		query = "SELECT COUNT(*) FROM extensions WHERE workspace_id = ?"
+	case QuotaConcurrentCalls:
+		query = "SELECT COUNT(*) FROM calls WHERE workspace_id = ? AND ended_at IS NULL"
+	default:
+		return 0, fmt.Errorf("unknown quota resource %s", resource)
+	}
+	var used int64
+	err := db.QueryRow(query, args...).Scan(&used)
+	if err != nil {
+		return 0, err
+	}
+	return used, nil
+}
+
+// GetQuotaUsage returns the Redis counter, seeding it from MySQL when missing
+func GetQuotaUsage(workspaceId int, resource QuotaResource) (int64, error) {
+	rdb, err := CreateRedisConn()
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	val, err := rdb.Get(quotaKey(workspaceId, resource, now)).Result()
+	if err == redis.Nil {
+		return seedQuota(workspaceId, resource, now)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(val, 10, 64)
+}
+
+// RecordUsage adjusts the usage counter, delta is negative when usage is released.
+// usage reserved through CheckQuota is already counted.
+func RecordUsage(workspaceId int, resource QuotaResource, delta int64) error {
+	rdb, err := CreateRedisConn()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	key := quotaKey(workspaceId, resource, now)
+	exists, err := rdb.Exists(key).Result()
+	if err != nil {
+		return err
+	}
+	if exists == 0 {
+		// usage not yet written to MySQL would be lost if delta was dropped here,
+		// the periodic reconcile corrects any double count
+		_, err = seedQuota(workspaceId, resource, now)
+		if err != nil {
+			return err
+		}
+	}
+	err = rdb.IncrBy(key, delta).Err()
+	if err != nil {
+		return err
+	}
+	if expireAt := quotaExpireAt(resource, now); expireAt > 0 {
+		rdb.ExpireAt(key, time.Unix(expireAt, 0))
+	}
+	return nil
+}
+
+// seedQuota sets a missing counter from MySQL without overwriting one set concurrently
+func seedQuota(workspaceId int, resource QuotaResource, now time.Time) (int64, error) {
+	used, err := CountQuotaUsage(workspaceId, resource, now)
+	if err != nil {
+		return 0, err
+	}
+	rdb, err := CreateRedisConn()
+	if err != nil {
+		return 0, err
+	}
+	key := quotaKey(workspaceId, resource, now)
+	var ttl time.Duration
+	if expireAt := quotaExpireAt(resource, now); expireAt > 0 {
+		ttl = time.Until(time.Unix(expireAt, 0))
+	}
+	set, err := rdb.SetNX(key, used, ttl).Result()
+	if err != nil {
+		return 0, err
+	}
+	if set {
+		return used, nil
+	}
+	return rdb.Get(key).Int64()
+}
+
+// ReconcileQuota overwrites the counter with the count from MySQL
+func ReconcileQuota(workspaceId int, resource QuotaResource) (int64, error) {
+	now := time.Now()
+	used, err := CountQuotaUsage(workspaceId, resource, now)
+	if err != nil {
+		return 0, err
+	}
+	rdb, err := CreateRedisConn()
+	if err != nil {
+		return 0, err
+	}
+	var ttl time.Duration
+	if expireAt := quotaExpireAt(resource, now); expireAt > 0 {
+		ttl = time.Until(time.Unix(expireAt, 0))
+	}
+	err = rdb.Set(quotaKey(workspaceId, resource, now), used, ttl).Err()
+	if err != nil {
+		return 0, err
+	}
+	return used, nil
+}
+
+// ReconcileAllQuotas resets every workspace's counters from MySQL, run it periodically
+// to correct drift from missed updates
+func ReconcileAllQuotas() error {
+	results, err := db.Query("SELECT id FROM workspaces")
+	if err != nil {
+		return err
+	}
+	workspaceIds := make([]int, 0)
+	for results.Next() {
+		var id int
+		err = results.Scan(&id)
+		if err != nil {
+			results.Close()
+			return err
+		}
+		workspaceIds = append(workspaceIds, id)
+	}
+	results.Close()
+
+	resources := []QuotaResource{QuotaRecordingBytes, QuotaFaxes, QuotaExtensions, QuotaConcurrentCalls}
+	for _, workspaceId := range workspaceIds {
+		for _, resource := range resources {
+			_, err = ReconcileQuota(workspaceId, resource)
+			if err != nil {
+				fmt.Printf("could not reconcile %s quota for workspace %d: %v\r\n", resource, workspaceId, err)
+			}
+		}
+	}
+	return nil
+}
+
+// reserveQuota runs reserveQuotaScript, seeding the counter first when it's missing
+func reserveQuota(workspaceId int, resource QuotaResource, limit int64, delta int64) (bool, int64, error) {
+	rdb, err := CreateRedisConn()
+	if err != nil {
+		return false, 0, err
+	}
+	now := time.Now()
+	key := quotaKey(workspaceId, resource, now)
+	expireAt := quotaExpireAt(resource, now)
+	for attempt := 0; attempt < 2; attempt++ {
+		res, err := rdb.Eval(reserveQuotaScript, []string{key}, limit, delta, expireAt).Result()
+		if err != nil {
+			return false, 0, err
+		}
+		values, ok := res.([]interface{})
+		if !ok || len(values) != 2 {
+			return false, 0, fmt.Errorf("unexpected quota script result %v", res)
+		}
+		status, _ := values[0].(int64)
+		total, _ := values[1].(int64)
+		if status >= 0 {
+			return status == 1, total, nil
+		}
+		_, err = seedQuota(workspaceId, resource, now)
+		if err != nil {
+			return false, 0, err
+		}
+	}
+	return false, 0, fmt.Errorf("could not seed %s quota for workspace %d", resource, workspaceId)
+}
+
+// CheckQuota reserves delta of the workspace's usage when it stays within its plan
+// limit. the check and the reservation are atomic so concurrent callers can't go
+// over a hard limit together. release usage that doesn't happen with RecordUsage
+// and a negative delta.
+func CheckQuota(workspace *Workspace, resource QuotaResource, delta int64) (*QuotaDecision, error) {
+	limit, unlimited, err := GetQuotaLimit(workspace, resource)
+	if err != nil {
+		return nil, err
+	}
+	scriptLimit := limit
+	if unlimited {
+		scriptLimit = -1
+	}
+	allowed, total, err := reserveQuota(workspace.Id, resource, scriptLimit, delta)
+	if err != nil {
+		return nil, err
+	}
+	decision := &QuotaDecision{Resource: resource, Used: total - delta, Delta: delta, Limit: limit, Unlimited: unlimited, Allowed: true, Level: QuotaLevelOk}
+	if unlimited {
+		return decision, nil
+	}
+	if !allowed {
+		decision.Used = total
+		decision.Allowed = false
+		decision.Level = QuotaLevelExceeded
+		return decision, nil
+	}
+	if limit <= 0 {
+		return decision, nil
+	}
+	pct := int(total * 100 / limit)
+	if pct >= 100 {
+		decision.Level = QuotaLevelFull
+	} else if pct >= quotaWarningThresholds[0] {
+		decision.Level = QuotaLevelWarning
+	}
+	for _, threshold := range quotaWarningThresholds {
+		if pct >= threshold {
+			sendQuotaWarning(workspace, resource, threshold, total, limit)
+		}
+	}
+	return decision, nil
+}
+
+func sendQuotaWarning(workspace *Workspace, resource QuotaResource, threshold int, used int64, limit int64) {
+	rdb, err := CreateRedisConn()
+	if err != nil {
+		return
+	}
+	key := fmt.Sprintf("quota_warning:%d:%s:%d:%s", workspace.Id, resource, threshold, time.Now().Format("2006-01"))
+	first, err := rdb.SetNX(key, 1, quotaWarningTTL).Result()
+	if err != nil || !first {
+		return
+	}
+	user, err := GetUserFromDB(workspace.CreatorId)
+	if err != nil {
+		fmt.Printf("could not get user for quota warning: %v\r\n", err)
+		return
+	}
+	body := fmt.Sprintf(`Your workspace %s has used %d%% of its %s allowance (%d of %d). Upgrade your plan to avoid interruptions.`,
+		workspace.Name, threshold, resource, used, limit)
+	SendEmail(user, "You are approaching your plan limit", body)
+}
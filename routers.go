@@ -0,0 +1,217 @@
+package helpers
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/clockworksoul/smudge"
+	"github.com/go-redis/redis"
+)
+
+const defaultRouterPinTTL = 2 * time.Hour
+
+// NoSIPRouterError is returned when neither the region nor any of its neighbours
+// has a router that can take traffic
+type NoSIPRouterError struct {
+	Region string
+}
+
+func (e *NoSIPRouterError) Error() string {
+	return fmt.Sprintf("no sip router available for region %s", e.Region)
+}
+
+func querySIPRouters(region string) ([]*SIPRouter, error) {
+	db, err := CreateDBConn()
+	if err != nil {
+		return nil, err
+	}
+	query := "SELECT id,ip_address,private_ip_address,region,live_status,live_call_count,live_cpu_pct_used FROM sip_routers"
+	args := []interface{}{}
+	if region != "" {
+		query = query + " WHERE region = ?"
+		args = append(args, region)
+	}
+	results, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	values := make([]*SIPRouter, 0)
+	for results.Next() {
+		value := SIPRouter{}
+		var status sql.NullString
+		var callCount sql.NullInt64
+		var cpu sql.NullFloat64
+		err := results.Scan(&value.Id, &value.IpAddress, &value.PrivateIpAddress, &value.Region, &status, &callCount, &cpu)
+		if err != nil {
+			return nil, err
+		}
+		value.Status = status.String
+		value.LiveCallCount = int(callCount.Int64)
+		value.LiveCPUPCTUsed = cpu.Float64
+		node, err := smudge.CreateNodeByAddress(value.IpAddress)
+		if err != nil {
+			return nil, err
+		}
+		value.Node = node
+		values = append(values, &value)
+	}
+	return values, results.Err()
+}
+
+func isRouterAvailable(router *SIPRouter) bool {
+	if !IsNodeAvailable(router.Status) {
+		return false
+	}
+	if m := GetMembership(); m != nil {
+		state := m.GetState(MemberKindSIPRouter, memberAddress(router.IpAddress, router.Node))
+		if state == MemberSuspected || state == MemberDead {
+			return false
+		}
+	}
+	return true
+}
+
+// SortSIPRouters orders routers that can take traffic first, then by load
+func SortSIPRouters(routers []*SIPRouter) {
+	sort.SliceStable(routers, func(i, j int) bool {
+		a, b := routers[i], routers[j]
+		aOk, bOk := isRouterAvailable(a), isRouterAvailable(b)
+		if aOk != bOk {
+			return aOk
+		}
+		if a.LiveCallCount != b.LiveCallCount {
+			return a.LiveCallCount < b.LiveCallCount
+		}
+		return a.LiveCPUPCTUsed < b.LiveCPUPCTUsed
+	})
+}
+
+// GetSIPRoutersForRegion returns the region's routers ordered by health and load
+func GetSIPRoutersForRegion(region string) ([]*SIPRouter, error) {
+	routers, err := querySIPRouters(region)
+	if err != nil {
+		return nil, err
+	}
+	SortSIPRouters(routers)
+	return routers, nil
+}
+
+// GetRegionFallbacks returns the regions to try after region, nearest first
+func GetRegionFallbacks(region string) ([]string, error) {
+	db, err := CreateDBConn()
+	if err != nil {
+		return nil, err
+	}
+	results, err := db.Query("SELECT neighbor_region FROM region_adjacency WHERE region = ? ORDER BY distance ASC", region)
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	regions := make([]string, 0)
+	for results.Next() {
+		var neighbor string
+		err = results.Scan(&neighbor)
+		if err != nil {
+			return nil, err
+		}
+		regions = append(regions, neighbor)
+	}
+	return regions, results.Err()
+}
+
+// SelectSIPRouters returns the routers that can take traffic for region, trying the
+// nearest neighbouring regions when the region itself has none
+func SelectSIPRouters(region string) ([]*SIPRouter, error) {
+	fallbacks, err := GetRegionFallbacks(region)
+	if err != nil {
+		return nil, err
+	}
+	for _, candidate := range append([]string{region}, fallbacks...) {
+		routers, err := GetSIPRoutersForRegion(candidate)
+		if err != nil {
+			return nil, err
+		}
+		available := make([]*SIPRouter, 0, len(routers))
+		for _, router := range routers {
+			if isRouterAvailable(router) {
+				available = append(available, router)
+			}
+		}
+		if len(available) > 0 {
+			return available, nil
+		}
+	}
+	return nil, &NoSIPRouterError{Region: region}
+}
+
+func SelectSIPRouter(region string) (*SIPRouter, error) {
+	routers, err := SelectSIPRouters(region)
+	if err != nil {
+		return nil, err
+	}
+	return routers[0], nil
+}
+
+func routerPinKey(sessionId string) string {
+	return "sip_router_pin:" + sessionId
+}
+
+// PinSIPRouter keeps a session on router so later requests in the dialog use it
+func PinSIPRouter(sessionId string, router *SIPRouter, ttl time.Duration) error {
+	rdb, err := CreateRedisConn()
+	if err != nil {
+		return err
+	}
+	if ttl == 0 {
+		ttl = defaultRouterPinTTL
+	}
+	return rdb.Set(routerPinKey(sessionId), router.Id, ttl).Err()
+}
+
+func UnpinSIPRouter(sessionId string) error {
+	rdb, err := CreateRedisConn()
+	if err != nil {
+		return err
+	}
+	return rdb.Del(routerPinKey(sessionId)).Err()
+}
+
+// SelectSIPRouterForSession returns the router pinned to the session while it is
+// still available, otherwise selects one for region and pins it
+func SelectSIPRouterForSession(sessionId string, region string) (*SIPRouter, error) {
+	rdb, err := CreateRedisConn()
+	if err != nil {
+		return nil, err
+	}
+	val, err := rdb.Get(routerPinKey(sessionId)).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	if err == nil {
+		routerId, _ := strconv.Atoi(val)
+		routers, err := querySIPRouters("")
+		if err != nil {
+			return nil, err
+		}
+		for _, router := range routers {
+			if router.Id == routerId && isRouterAvailable(router) {
+				return router, nil
+			}
+		}
+	}
+	router, err := SelectSIPRouter(region)
+	if err != nil {
+		return nil, err
+	}
+	err = PinSIPRouter(sessionId, router, defaultRouterPinTTL)
+	if err != nil {
+		fmt.Printf("could not pin session %s to router %d: %v\r\n", sessionId, router.Id, err)
+	}
+	return router, nil
+}
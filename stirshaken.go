@@ -0,0 +1,597 @@
+package helpers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	guuid "github.com/google/uuid"
+)
+
+const (
+	AttestationFull    = "A"
+	AttestationPartial = "B"
+	AttestationGateway = "C"
+)
+
+// PASSporTs older than this are rejected as replays
+const passportMaxAge = 60 * time.Second
+
+const certificateCacheTTL = time.Hour
+
+// x5u urls come from untrusted headers, so bound what a fetch and the cache can hold
+const (
+	maxCertificateBytes   = 64 * 1024
+	maxCachedCertificates = 1000
+)
+
+var (
+	ErrInvalidIdentityHeader = errors.New("invalid identity header")
+	ErrPASSporTSignature     = errors.New("passport signature does not verify")
+	ErrPASSporTStale         = errors.New("passport is too old")
+	ErrPASSporTNumbers       = errors.New("passport numbers do not match the call")
+	ErrNoStirShakenSigner    = errors.New("stir/shaken signing key not configured")
+)
+
+type PASSporTHeader struct {
+	Alg string `json:"alg"`
+	Ppt string `json:"ppt"`
+	Typ string `json:"typ"`
+	X5u string `json:"x5u"`
+}
+
+type PASSporTTelephoneNumbers struct {
+	Tn []string `json:"tn"`
+}
+
+type PASSporTOrig struct {
+	Tn string `json:"tn"`
+}
+
+type PASSporTClaims struct {
+	Attest string                   `json:"attest"`
+	Dest   PASSporTTelephoneNumbers `json:"dest"`
+	Iat    int64                    `json:"iat"`
+	Orig   PASSporTOrig             `json:"orig"`
+	OrigId string                   `json:"origid"`
+}
+
+// StirShakenSigner signs PASSporTs with the key matching the certificate served at CertURL
+type StirShakenSigner struct {
+	PrivateKey *ecdsa.PrivateKey
+	CertURL    string
+}
+
+// CertificateRepository fetches the signing certificate named by a PASSporT's x5u and
+// knows which roots to trust
+type CertificateRepository interface {
+	GetCertificates(url string) ([]*x509.Certificate, error)
+	Roots() *x509.CertPool
+}
+
+var stirShakenSigner *StirShakenSigner
+var stirShakenSignerErr error
+var stirShakenSignerOnce sync.Once
+
+// GetStirShakenSigner loads the signing key from STIR_SHAKEN_KEY_FILE, with the
+// certificate URL from STIR_SHAKEN_CERT_URL. a key that fails to load keeps
+// returning its error.
+func GetStirShakenSigner() (*StirShakenSigner, error) {
+	stirShakenSignerOnce.Do(func() {
+		keyFile := os.Getenv("STIR_SHAKEN_KEY_FILE")
+		if keyFile == "" {
+			return
+		}
+		data, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			stirShakenSignerErr = err
+			return
+		}
+		key, err := ParseECPrivateKeyPEM(data)
+		if err != nil {
+			stirShakenSignerErr = err
+			return
+		}
+		stirShakenSigner = &StirShakenSigner{PrivateKey: key, CertURL: os.Getenv("STIR_SHAKEN_CERT_URL")}
+	})
+	if stirShakenSignerErr != nil {
+		return nil, stirShakenSignerErr
+	}
+	if stirShakenSigner == nil {
+		return nil, ErrNoStirShakenSigner
+	}
+	return stirShakenSigner, nil
+}
+
+func ParseECPrivateKeyPEM(data []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("key is not an ECDSA key")
+	}
+	return key, nil
+}
+
+// DetermineAttestation maps a caller id check to an attestation level. numbers we
+// assigned or the customer proved ownership of get full attestation, BYO carrier
+// numbers partial, anything else gateway.
+func DetermineAttestation(verification *CallerIdVerification) string {
+	if verification == nil || !verification.Verified {
+		return AttestationGateway
+	}
+	switch verification.Source {
+	case CallerIdSourceDID, CallerIdSourceVerified:
+		return AttestationFull
+	case CallerIdSourceBYODID:
+		return AttestationPartial
+	}
+	return AttestationGateway
+}
+
+// passportNumber is the canonical tn form, digits only
+func passportNumber(number string) string {
+	num, err := NormalizeNumber(number, "")
+	if err == nil {
+		return blocklistDigits(num.E164)
+	}
+	return blocklistDigits(ExtractNumber(number))
+}
+
+func encodeSegment(value interface{}) (string, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// Sign returns the compact PASSporT for claims
+func (s *StirShakenSigner) Sign(claims *PASSporTClaims) (string, error) {
+	header, err := encodeSegment(&PASSporTHeader{Alg: "ES256", Ppt: "shaken", Typ: "passport", X5u: s.CertURL})
+	if err != nil {
+		return "", err
+	}
+	payload, err := encodeSegment(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := header + "." + payload
+	digest := sha256.Sum256([]byte(signingInput))
+	r, sig, err := ecdsa.Sign(rand.Reader, s.PrivateKey, digest[:])
+	if err != nil {
+		return "", err
+	}
+	// ES256 signatures are r and s as fixed 32 byte big endian values
+	raw := make([]byte, 64)
+	r.FillBytes(raw[:32])
+	sig.FillBytes(raw[32:])
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// CreatePASSporT builds the claims for a call from one number to another. numbers
+// not in E.164 are read as dialled in the default region.
+func CreatePASSporT(from string, to string, attestation string, now time.Time) *PASSporTClaims {
+	return &PASSporTClaims{
+		Attest: attestation,
+		Dest:   PASSporTTelephoneNumbers{Tn: []string{passportNumber(to)}},
+		Iat:    now.Unix(),
+		Orig:   PASSporTOrig{Tn: passportNumber(from)},
+		OrigId: guuid.New().String(),
+	}
+}
+
+func BuildIdentityHeader(token string, certURL string) string {
+	return fmt.Sprintf("%s;info=<%s>;alg=ES256;ppt=shaken", token, certURL)
+}
+
+// SignOutboundCall attests the workspace's caller id and returns the SIP Identity
+// header value along with the attestation used
+func SignOutboundCall(workspace *Workspace, from string, to string) (string, string, error) {
+	signer, err := GetStirShakenSigner()
+	if err != nil {
+		return "", "", err
+	}
+	verification, err := VerifyCallerId(workspace, from)
+	if err != nil {
+		return "", "", err
+	}
+	attestation := DetermineAttestation(verification)
+	// orig must be the number that was attested, both are E.164 in the workspace's region
+	dest, err := NormalizeWorkspaceNumber(workspace, to)
+	if err != nil {
+		return "", "", err
+	}
+	token, err := signer.Sign(CreatePASSporT(verification.Number, dest.E164, attestation, time.Now()))
+	if err != nil {
+		return "", "", err
+	}
+	return BuildIdentityHeader(token, signer.CertURL), attestation, nil
+}
+
+// ParseIdentityHeader splits an Identity header into the token and its parameters
+func ParseIdentityHeader(header string) (string, map[string]string, error) {
+	parts := strings.Split(strings.TrimSpace(header), ";")
+	token := strings.TrimSpace(parts[0])
+	if strings.Count(token, ".") != 2 {
+		return "", nil, ErrInvalidIdentityHeader
+	}
+	params := make(map[string]string)
+	for _, part := range parts[1:] {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		params[strings.ToLower(kv[0])] = strings.Trim(kv[1], "<>\"")
+	}
+	return token, params, nil
+}
+
+func decodeSegment(segment string, value interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
+
+// VerifyIdentityHeader checks an inbound call's Identity header: the certificate chains
+// to a trusted root, the signature verifies, the token is fresh and it was issued
+// for this call's numbers
+func VerifyIdentityHeader(header string, from string, to string, now time.Time, repo CertificateRepository) (*PASSporTClaims, error) {
+	token, params, err := ParseIdentityHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	segments := strings.Split(token, ".")
+	var passportHeader PASSporTHeader
+	err = decodeSegment(segments[0], &passportHeader)
+	if err != nil {
+		return nil, ErrInvalidIdentityHeader
+	}
+	if passportHeader.Alg != "ES256" || passportHeader.Ppt != "shaken" {
+		return nil, fmt.Errorf("unsupported passport alg %s ppt %s", passportHeader.Alg, passportHeader.Ppt)
+	}
+	var claims PASSporTClaims
+	err = decodeSegment(segments[1], &claims)
+	if err != nil {
+		return nil, ErrInvalidIdentityHeader
+	}
+
+	certURL := passportHeader.X5u
+	if certURL == "" {
+		certURL = params["info"]
+	}
+	certs, err := repo.GetCertificates(certURL)
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate at %s", certURL)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err = certs[0].Verify(x509.VerifyOptions{
+		Roots:         repo.Roots(),
+		Intermediates: intermediates,
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, err
+	}
+	publicKey, ok := certs[0].PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("certificate key is not ECDSA")
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(segments[2])
+	if err != nil || len(sig) != 64 {
+		return nil, ErrPASSporTSignature
+	}
+	digest := sha256.Sum256([]byte(segments[0] + "." + segments[1]))
+	r := new(big.Int).SetBytes(sig[:32])
+	s := new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(publicKey, digest[:], r, s) {
+		return nil, ErrPASSporTSignature
+	}
+
+	age := now.Sub(time.Unix(claims.Iat, 0))
+	if age > passportMaxAge || age < -passportMaxAge {
+		return nil, ErrPASSporTStale
+	}
+	if claims.Orig.Tn != passportNumber(from) {
+		return nil, ErrPASSporTNumbers
+	}
+	destMatch := false
+	for _, tn := range claims.Dest.Tn {
+		if tn == passportNumber(to) {
+			destMatch = true
+		}
+	}
+	if !destMatch {
+		return nil, ErrPASSporTNumbers
+	}
+	return &claims, nil
+}
+
+func parseCertificatesPEM(data []byte) ([]*x509.Certificate, error) {
+	certs := make([]*x509.Certificate, 0)
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+type cachedCertificates struct {
+	certs     []*x509.Certificate
+	fetchedAt time.Time
+}
+
+// HTTPCertificateRepository downloads x5u certificates from the STI-CR hosts in
+// AllowedHosts and caches up to maxCachedCertificates of them for an hour
+type HTTPCertificateRepository struct {
+	Client     *http.Client
+	TrustRoots *x509.CertPool
+	// AllowedHosts are exact hosts, or domains with a leading dot to allow their subdomains
+	AllowedHosts []string
+	mu           sync.Mutex
+	cache        map[string]*cachedCertificates
+}
+
+func NewHTTPCertificateRepository(roots *x509.CertPool, allowedHosts []string) *HTTPCertificateRepository {
+	repo := &HTTPCertificateRepository{
+		TrustRoots:   roots,
+		AllowedHosts: allowedHosts,
+		cache:        make(map[string]*cachedCertificates),
+	}
+	repo.Client = &http.Client{
+		Timeout: 5 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			// a redirect must not lead off the allowlist
+			return repo.checkCertificateURL(req.URL)
+		},
+	}
+	return repo
+}
+
+func (r *HTTPCertificateRepository) allowedHost(host string) bool {
+	host = strings.ToLower(host)
+	for _, allowed := range r.AllowedHosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || (strings.HasPrefix(allowed, ".") && strings.HasSuffix(host, allowed)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *HTTPCertificateRepository) checkCertificateURL(u *url.URL) error {
+	if u.Scheme != "https" {
+		return fmt.Errorf("certificate url must be https: %s", u)
+	}
+	if u.User != nil || !r.allowedHost(u.Hostname()) {
+		return fmt.Errorf("certificate host %s is not an allowed STI-CR", u.Hostname())
+	}
+	return nil
+}
+
+// CreateCertificateRepository trusts the PEM roots in STIR_SHAKEN_ROOTS_FILE and fetches
+// certificates from the comma separated hosts in STIR_SHAKEN_CERT_HOSTS
+func CreateCertificateRepository() (*HTTPCertificateRepository, error) {
+	roots := x509.NewCertPool()
+	if rootsFile := os.Getenv("STIR_SHAKEN_ROOTS_FILE"); rootsFile != "" {
+		data, err := ioutil.ReadFile(rootsFile)
+		if err != nil {
+			return nil, err
+		}
+		if !roots.AppendCertsFromPEM(data) {
+			return nil, errors.New("no certificates in " + rootsFile)
+		}
+	}
+	allowedHosts := make([]string, 0)
+	for _, host := range strings.Split(os.Getenv("STIR_SHAKEN_CERT_HOSTS"), ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			allowedHosts = append(allowedHosts, host)
+		}
+	}
+	return NewHTTPCertificateRepository(roots, allowedHosts), nil
+}
+
+func (r *HTTPCertificateRepository) Roots() *x509.CertPool {
+	return r.TrustRoots
+}
+
+func (r *HTTPCertificateRepository) GetCertificates(certURL string) ([]*x509.Certificate, error) {
+	parsed, err := url.Parse(certURL)
+	if err != nil {
+		return nil, err
+	}
+	err = r.checkCertificateURL(parsed)
+	if err != nil {
+		return nil, err
+	}
+	certURL = parsed.String()
+	r.mu.Lock()
+	cached, ok := r.cache[certURL]
+	r.mu.Unlock()
+	if ok && time.Since(cached.fetchedAt) < certificateCacheTTL {
+		return cached.certs, nil
+	}
+	resp, err := r.Client.Get(certURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s returned %d", certURL, resp.StatusCode)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxCertificateBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxCertificateBytes {
+		return nil, fmt.Errorf("certificate at %s is larger than %d bytes", certURL, maxCertificateBytes)
+	}
+	certs, err := parseCertificatesPEM(data)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	r.store(certURL, certs, time.Now())
+	r.mu.Unlock()
+	return certs, nil
+}
+
+// store caches certs for url, evicting expired entries and then the oldest when full.
+// callers hold r.mu.
+func (r *HTTPCertificateRepository) store(url string, certs []*x509.Certificate, now time.Time) {
+	if _, ok := r.cache[url]; !ok && len(r.cache) >= maxCachedCertificates {
+		oldestURL := ""
+		var oldest time.Time
+		for key, cached := range r.cache {
+			if now.Sub(cached.fetchedAt) >= certificateCacheTTL {
+				delete(r.cache, key)
+				continue
+			}
+			if oldestURL == "" || cached.fetchedAt.Before(oldest) {
+				oldestURL = key
+				oldest = cached.fetchedAt
+			}
+		}
+		if len(r.cache) >= maxCachedCertificates {
+			delete(r.cache, oldestURL)
+		}
+	}
+	r.cache[url] = &cachedCertificates{certs: certs, fetchedAt: now}
+}
+
+// StaticCertificateRepository serves certificates from memory, for offline testing
+type StaticCertificateRepository struct {
+	Certificates map[string][]*x509.Certificate
+	TrustRoots   *x509.CertPool
+}
+
+func (r *StaticCertificateRepository) Roots() *x509.CertPool {
+	return r.TrustRoots
+}
+
+func (r *StaticCertificateRepository) GetCertificates(url string) ([]*x509.Certificate, error) {
+	certs, ok := r.Certificates[url]
+	if !ok {
+		return nil, fmt.Errorf("no certificate at %s", url)
+	}
+	return certs, nil
+}
+
+type StirShakenTestCredentials struct {
+	Signer     *StirShakenSigner
+	Repository *StaticCertificateRepository
+	RootPEM    []byte
+	CertPEM    []byte
+	KeyPEM     []byte
+}
+
+// GenerateStirShakenTestCredentials creates a throwaway root CA and signing certificate
+// served at certURL so signing and verification can be exercised offline
+func GenerateStirShakenTestCredentials(certURL string) (*StirShakenTestCredentials, error) {
+	now := time.Now()
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	rootTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Lineblocs Test STI Root"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(1, 0, 0),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	rootDER, err := x509.CreateCertificate(rand.Reader, rootTemplate, rootTemplate, &rootKey.PublicKey, rootKey)
+	if err != nil {
+		return nil, err
+	}
+	root, err := x509.ParseCertificate(rootDER)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "Lineblocs Test SHAKEN"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, root, &key.PublicKey, rootKey)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	return &StirShakenTestCredentials{
+		Signer: &StirShakenSigner{PrivateKey: key, CertURL: certURL},
+		Repository: &StaticCertificateRepository{
+			Certificates: map[string][]*x509.Certificate{certURL: {cert}},
+			TrustRoots:   roots,
+		},
+		RootPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rootDER}),
+		CertPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}),
+		KeyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}, nil
+}
@@ -0,0 +1,89 @@
+package helpers
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testCertURL = "https://certs.example.com/shaken.pem"
+
+func TestVerifyIdentityHeader(t *testing.T) {
+	creds, err := GenerateStirShakenTestCredentials(testCertURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	from := "+14155550100"
+	to := "+14155550101"
+	sign := func(from string, iat time.Time) string {
+		token, err := creds.Signer.Sign(CreatePASSporT(from, to, AttestationFull, iat))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return BuildIdentityHeader(token, testCertURL)
+	}
+	tamper := func(header string) string {
+		// change the first signature character so the token no longer verifies
+		sigStart := strings.LastIndex(strings.SplitN(header, ";", 2)[0], ".") + 1
+		replacement := "A"
+		if header[sigStart] == 'A' {
+			replacement = "B"
+		}
+		return header[:sigStart] + replacement + header[sigStart+1:]
+	}
+
+	tests := []struct {
+		name    string
+		header  string
+		from    string
+		wantErr error
+	}{
+		{"valid", sign(from, now), from, nil},
+		{"stale iat", sign(from, now.Add(-2*passportMaxAge)), from, ErrPASSporTStale},
+		{"wrong origination number", sign("+14155550199", now), from, ErrPASSporTNumbers},
+		{"bad signature", tamper(sign(from, now)), from, ErrPASSporTSignature},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := VerifyIdentityHeader(tt.header, tt.from, to, now, creds.Repository)
+			if err != tt.wantErr {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			if tt.wantErr == nil && claims.Attest != AttestationFull {
+				t.Fatalf("expected attestation %s, got %s", AttestationFull, claims.Attest)
+			}
+		})
+	}
+}
+
+func TestHTTPCertificateRepositoryAllowlist(t *testing.T) {
+	repo := NewHTTPCertificateRepository(nil, []string{"certs.example.com", ".sticr.example.org"})
+	tests := []struct {
+		url     string
+		allowed bool
+	}{
+		{"https://certs.example.com/a.pem", true},
+		{"https://cr.sticr.example.org/a.pem", true},
+		{"http://certs.example.com/a.pem", false},
+		{"https://169.254.169.254/latest/meta-data", false},
+		{"https://certs.example.com.evil.test/a.pem", false},
+		{"https://user@certs.example.com/a.pem", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			parsed, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = repo.checkCertificateURL(parsed)
+			if tt.allowed && err != nil {
+				t.Fatalf("expected the url to be allowed, got %v", err)
+			}
+			if !tt.allowed && err == nil {
+				t.Fatal("expected the url to be rejected")
+			}
+		})
+	}
+}
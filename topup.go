@@ -0,0 +1,304 @@
+package helpers
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+	guuid "github.com/google/uuid"
+)
+
+const autoTopupLockTTL = 2 * time.Minute
+
+const autoTopupCreditSource = "AUTO_TOPUP"
+
+// how long auto top-up stays paused after a failed charge unless the card changes
+const autoTopupFailureTTL = 24 * time.Hour
+
+// only delete the lock if we still own it
+const releaseLockScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`
+
+func acquireLock(key string, ttl time.Duration) (string, bool, error) {
+	rdb, err := CreateRedisConn()
+	if err != nil {
+		return "", false, err
+	}
+	token := guuid.New().String()
+	ok, err := rdb.SetNX(key, token, ttl).Result()
+	if err != nil {
+		return "", false, err
+	}
+	return token, ok, nil
+}
+
+func releaseLock(key string, token string) {
+	rdb, err := CreateRedisConn()
+	if err != nil {
+		return
+	}
+	err = rdb.Eval(releaseLockScript, []string{key}, token).Err()
+	if err != nil {
+		fmt.Printf("could not release lock %s: %v\r\n", key, err)
+	}
+}
+
+func CreateCredit(workspaceId int, cents int64, source string) error {
+	now := time.Now()
+	_, err := db.Exec("INSERT INTO users_credits (`workspace_id`, `cents`, `source`, `created_at`, `updated_at`) VALUES ( ?, ?, ?, ?, ? )",
+		workspaceId, cents, source, now, now)
+	return err
+}
+
+func autoTopupFailureKey(workspaceId int) string {
+	return "autotopup_failed:" + strconv.Itoa(workspaceId)
+}
+
+// primaryCardRef identifies the saved card a failure was recorded against, empty
+// when the workspace pays through a provider without saved cards
+func primaryCardRef(workspaceId int) (string, error) {
+	method, err := GetPrimaryPaymentMethod(workspaceId)
+	if err == ErrNoPaymentMethod {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return method.StripeId, nil
+}
+
+// autoTopupPaused tells whether a previous top-up failed with the card still on file
+func autoTopupPaused(workspaceId int) (bool, error) {
+	rdb, err := CreateRedisConn()
+	if err != nil {
+		return false, err
+	}
+	failedCard, err := rdb.Get(autoTopupFailureKey(workspaceId)).Result()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	card, err := primaryCardRef(workspaceId)
+	if err != nil {
+		return false, err
+	}
+	return card == failedCard, nil
+}
+
+func markAutoTopupFailed(workspaceId int) {
+	rdb, err := CreateRedisConn()
+	if err != nil {
+		return
+	}
+	card, err := primaryCardRef(workspaceId)
+	if err != nil {
+		fmt.Printf("could not get card for workspace %d: %v\r\n", workspaceId, err)
+	}
+	err = rdb.Set(autoTopupFailureKey(workspaceId), card, autoTopupFailureTTL).Err()
+	if err != nil {
+		fmt.Printf("could not pause auto top-up for workspace %d: %v\r\n", workspaceId, err)
+	}
+}
+
+// ClearAutoTopupFailure resumes auto top-up straight away, e.g. after the customer
+// retried a payment by hand
+func ClearAutoTopupFailure(workspaceId int) error {
+	rdb, err := CreateRedisConn()
+	if err != nil {
+		return err
+	}
+	return rdb.Del(autoTopupFailureKey(workspaceId)).Err()
+}
+
+// CreatePendingCredit remembers a credit to post once a pending payment succeeds
+func CreatePendingCredit(workspaceId int, paymentIntentId string, cents int64, source string) error {
+	now := time.Now()
+	_, err := db.Exec("INSERT INTO pending_credits (`workspace_id`, `payment_intent_id`, `cents`, `source`, `created_at`) VALUES ( ?, ?, ?, ?, ? )",
+		workspaceId, paymentIntentId, cents, source, now)
+	return err
+}
+
+func hasPendingCredit(workspaceId int, source string) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM pending_credits WHERE workspace_id = ? AND source = ?", workspaceId, source).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// SettlePendingCredit posts the credit waiting on a payment. it does nothing when
+// there is none, so payments that were credited straight away aren't credited twice.
+func SettlePendingCredit(paymentIntentId string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	var id int
+	var workspaceId int
+	var cents int64
+	var source string
+	row := tx.QueryRow("SELECT id, workspace_id, cents, source FROM pending_credits WHERE payment_intent_id = ? FOR UPDATE", paymentIntentId)
+	err = row.Scan(&id, &workspaceId, &cents, &source)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return nil
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	now := time.Now()
+	_, err = tx.Exec("INSERT INTO users_credits (`workspace_id`, `cents`, `source`, `created_at`, `updated_at`) VALUES ( ?, ?, ?, ?, ? )",
+		workspaceId, cents, source, now, now)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM pending_credits WHERE id = ?", id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// FailPendingCredit drops the credit waiting on a payment that failed. failed
+// top-ups pause auto top-up like a decline.
+func FailPendingCredit(paymentIntentId string) error {
+	var workspaceId int
+	var source string
+	row := db.QueryRow("SELECT workspace_id, source FROM pending_credits WHERE payment_intent_id = ?", paymentIntentId)
+	err := row.Scan(&workspaceId, &source)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DELETE FROM pending_credits WHERE payment_intent_id = ?", paymentIntentId)
+	if err != nil {
+		return err
+	}
+	if source == autoTopupCreditSource {
+		markAutoTopupFailed(workspaceId)
+	}
+	return nil
+}
+
+// ProcessAutoTopup should be called after each debit with the debit's id. when the
+// remaining balance has dropped below the subscription's threshold it charges the
+// saved payment method for the top-up amount and posts a credit. after a failed
+// charge it stays paused until the card changes or autoTopupFailureTTL passes.
+// returns nil when no top-up was attempted.
+func ProcessAutoTopup(workspaceId int, debitId int) (*PaymentResult, error) {
+	sub, err := GetSubscription(workspaceId)
+	if err != nil {
+		return nil, err
+	}
+	if !sub.AutoTopupEnabled || sub.AutoTopupAmount <= 0 {
+		return nil, nil
+	}
+	workspace, err := GetWorkspaceFromDB(workspaceId)
+	if err != nil {
+		return nil, err
+	}
+	info, err := GetWorkspaceBillingInfo(workspace)
+	if err != nil {
+		return nil, err
+	}
+	if info.RemainingBalanceCents >= int64(sub.AutoTopupThreshold) {
+		return nil, nil
+	}
+	paused, err := autoTopupPaused(workspaceId)
+	if err != nil {
+		return nil, err
+	}
+	if paused {
+		return nil, nil
+	}
+	lockKey := "autotopup_lock:" + strconv.Itoa(workspaceId)
+	token, ok, err := acquireLock(lockKey, autoTopupLockTTL)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		// another debit is already topping up this workspace
+		return nil, nil
+	}
+	defer releaseLock(lockKey, token)
+
+	// checked under the lock so a top-up that just went pending isn't charged again
+	pending, err := hasPendingCredit(workspaceId, autoTopupCreditSource)
+	if err != nil {
+		return nil, err
+	}
+	if pending {
+		// the last top-up hasn't settled yet
+		return nil, nil
+	}
+
+	// the balance may have been topped up while we were waiting
+	info, err = GetWorkspaceBillingInfo(workspace)
+	if err != nil {
+		return nil, err
+	}
+	if info.RemainingBalanceCents >= int64(sub.AutoTopupThreshold) {
+		return nil, nil
+	}
+
+	user, err := GetUserFromDB(workspace.CreatorId)
+	if err != nil {
+		return nil, err
+	}
+	provider, err := GetPaymentProvider(workspace)
+	if err != nil {
+		return nil, err
+	}
+	// retries for the same debit must not charge twice
+	result, err := provider.Charge(user, workspace, &ChargeReq{
+		Cents:          sub.AutoTopupAmount,
+		Description:    "Automatic balance top-up",
+		IdempotencyKey: CreatePaymentIdempotencyKey(workspaceId, "topup", strconv.Itoa(debitId)),
+	})
+	if err != nil {
+		markAutoTopupFailed(workspaceId)
+		notifyAutoTopupFailed(user, sub, err.Error())
+		return nil, err
+	}
+	if result.Status == PaymentPending {
+		// credited by the payment_intent.succeeded webhook once the payment settles
+		err = CreatePendingCredit(workspaceId, result.PaymentIntentId, int64(sub.AutoTopupAmount), autoTopupCreditSource)
+		if err != nil {
+			fmt.Printf("could not save pending top-up for workspace %d payment %s: %v\r\n", workspaceId, result.PaymentIntentId, err)
+			return result, err
+		}
+		return result, nil
+	}
+	if result.Status != PaymentSucceeded {
+		reason := string(result.Status)
+		if result.DeclineCode != "" {
+			reason = reason + " (" + result.DeclineCode + ")"
+		}
+		markAutoTopupFailed(workspaceId)
+		notifyAutoTopupFailed(user, sub, reason)
+		return result, nil
+	}
+
+	err = CreateCredit(workspaceId, int64(sub.AutoTopupAmount), autoTopupCreditSource)
+	if err != nil {
+		// the card was charged so this needs manual reconciliation
+		fmt.Printf("could not post top-up credit for workspace %d payment %s: %v\r\n", workspaceId, result.PaymentIntentId, err)
+		return result, err
+	}
+	return result, nil
+}
+
+func notifyAutoTopupFailed(user *User, sub *Subscription, reason string) {
+	body := fmt.Sprintf(`Your automatic top-up of $%d.%02d could not be completed: %s. Please update your payment method to avoid service interruption.`,
+		sub.AutoTopupAmount/100, sub.AutoTopupAmount%100, reason)
+	SendEmail(user, "Automatic top-up failed", body)
+}
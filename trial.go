@@ -0,0 +1,180 @@
+package helpers
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type TrialState string
+
+const (
+	TrialNotApplicable TrialState = "not-applicable"
+	TrialActive        TrialState = "active"
+	TrialPendingExpiry TrialState = "pending-expiry"
+	TrialExpired       TrialState = "expired"
+	// TrialEnded means the trial was cut short by a purchase
+	TrialEnded TrialState = "ended"
+)
+
+// DefaultTrialDays is used for plans that don't set free_trial_days
+const DefaultTrialDays = 10
+
+// trials with this many days or fewer left are pending expiry
+const trialPendingExpiryDays = 3
+
+// DefaultTrialReminderDays are the days before expiry reminders are sent,
+// TRIAL_REMINDER_DAYS overrides them as a comma separated list
+var DefaultTrialReminderDays = []int{7, 3, 1}
+
+type TrialStatus struct {
+	State         TrialState `json:"state"`
+	StartedAt     *time.Time `json:"started_at"`
+	EndsAt        *time.Time `json:"ends_at"`
+	DaysRemaining int        `json:"days_remaining"`
+}
+
+func GetTrialLength(plan *ServicePlan) int {
+	if plan != nil && plan.FreeTrialDays > 0 {
+		return plan.FreeTrialDays
+	}
+	return DefaultTrialDays
+}
+
+func evaluateTrialWindow(start time.Time, end time.Time, now time.Time) *TrialStatus {
+	status := &TrialStatus{StartedAt: &start, EndsAt: &end}
+	if !now.Before(end) {
+		status.State = TrialExpired
+		return status
+	}
+	status.DaysRemaining = int(math.Ceil(end.Sub(now).Hours() / 24))
+	status.State = TrialActive
+	if status.DaysRemaining <= trialPendingExpiryDays {
+		status.State = TrialPendingExpiry
+	}
+	return status
+}
+
+// EvaluateTrialStatus works out the trial state from the subscription's trial dates,
+// falling back to the plan's trial length when no end date is stored
+func EvaluateTrialStatus(sub *Subscription, plan *ServicePlan, now time.Time) *TrialStatus {
+	if sub == nil || sub.FreeTrialStartDate == nil || (plan != nil && plan.FreeTrialExempt) {
+		return &TrialStatus{State: TrialNotApplicable}
+	}
+	start := *sub.FreeTrialStartDate
+	end := start.AddDate(0, 0, GetTrialLength(plan))
+	if sub.FreeTrialEndDate != nil {
+		end = *sub.FreeTrialEndDate
+	}
+	// a converted trial on a plan that ends it on purchase ended at conversion, others
+	// keep running until their end date
+	if !sub.IsFreeTrialActive && plan != nil && plan.TrialEndsOnPurchase {
+		return &TrialStatus{State: TrialEnded, StartedAt: &start, EndsAt: &end}
+	}
+	return evaluateTrialWindow(start, end, now)
+}
+
+func GetTrialStatus(workspaceId int, now time.Time) (*TrialStatus, error) {
+	sub, err := GetSubscription(workspaceId)
+	if err == ErrSubscriptionNotFound {
+		return &TrialStatus{State: TrialNotApplicable}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	plan, err := GetServicePlan(sub.CurrentPlanId)
+	if err != nil {
+		return nil, err
+	}
+	return EvaluateTrialStatus(sub, plan, now), nil
+}
+
+// GetTrialReminderDays returns reminder offsets from largest to smallest
+func GetTrialReminderDays() []int {
+	days := DefaultTrialReminderDays
+	if val := os.Getenv("TRIAL_REMINDER_DAYS"); val != "" {
+		days = make([]int, 0)
+		for _, part := range strings.Split(val, ",") {
+			day, err := strconv.Atoi(strings.TrimSpace(part))
+			if err != nil {
+				fmt.Printf("ignoring invalid trial reminder day %s\r\n", part)
+				continue
+			}
+			days = append(days, day)
+		}
+	}
+	sorted := append([]int{}, days...)
+	sort.Sort(sort.Reverse(sort.IntSlice(sorted)))
+	return sorted
+}
+
+// SendTrialReminders emails workspaces whose trials are about to expire. it's meant
+// to run periodically, each reminder is only sent once.
+func SendTrialReminders(now time.Time) error {
+	results, err := db.Query("SELECT workspace_id FROM subscriptions WHERE is_free_trial_active = 1")
+	if err != nil {
+		return err
+	}
+	workspaceIds := make([]int, 0)
+	for results.Next() {
+		var id int
+		err = results.Scan(&id)
+		if err != nil {
+			results.Close()
+			return err
+		}
+		workspaceIds = append(workspaceIds, id)
+	}
+	results.Close()
+
+	reminderDays := GetTrialReminderDays()
+	for _, workspaceId := range workspaceIds {
+		status, err := GetTrialStatus(workspaceId, now)
+		if err != nil {
+			fmt.Printf("could not get trial status for workspace %d: %v\r\n", workspaceId, err)
+			continue
+		}
+		if status.State != TrialActive && status.State != TrialPendingExpiry {
+			continue
+		}
+		// only the closest reminder is due, earlier ones that were missed are skipped
+		due := -1
+		for _, days := range reminderDays {
+			if status.DaysRemaining <= days {
+				due = days
+			}
+		}
+		if due == -1 {
+			continue
+		}
+		err = sendTrialReminder(workspaceId, status, due, now)
+		if err != nil {
+			fmt.Printf("could not send trial reminder for workspace %d: %v\r\n", workspaceId, err)
+		}
+	}
+	return nil
+}
+
+func sendTrialReminder(workspaceId int, status *TrialStatus, days int, now time.Time) error {
+	rdb, err := CreateRedisConn()
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("trial_reminder:%d:%s:%d", workspaceId, status.EndsAt.Format("20060102"), days)
+	first, err := rdb.SetNX(key, 1, status.EndsAt.Sub(now)+24*time.Hour).Result()
+	if err != nil || !first {
+		return err
+	}
+	user, _, err := getSubscriptionOwner(workspaceId)
+	if err != nil {
+		return err
+	}
+	body := fmt.Sprintf(`Your free trial ends in %d day(s) on %s. Choose a plan to keep your numbers and call flows running.`,
+		status.DaysRemaining, status.EndsAt.Format("2006 Jan 02"))
+	SendEmail(user, "Your free trial is ending soon", body)
+	return nil
+}
@@ -0,0 +1,39 @@
+package helpers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConvertedTrialStatus(t *testing.T) {
+	start := time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2023, 5, 11, 0, 0, 0, 0, time.UTC)
+	convertedAt := time.Date(2023, 5, 4, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name           string
+		endsOnPurchase bool
+		now            time.Time
+		want           TrialState
+	}{
+		{"ends on purchase", true, convertedAt.Add(time.Hour), TrialEnded},
+		{"keeps running after purchase", false, convertedAt.Add(time.Hour), TrialActive},
+		{"expires at its original end", false, end.Add(time.Hour), TrialExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan := &ServicePlan{TrialEndsOnPurchase: tt.endsOnPurchase}
+			sub := &Subscription{IsFreeTrialActive: true, FreeTrialStartDate: &start, FreeTrialEndDate: &end}
+			// what ConvertTrial stores
+			sub.FreeTrialEndDate = convertedTrialEnd(sub, plan, convertedAt)
+			sub.IsFreeTrialActive = false
+
+			status := EvaluateTrialStatus(sub, plan, tt.now)
+			if status.State != tt.want {
+				t.Fatalf("expected %s, got %s", tt.want, status.State)
+			}
+			if !tt.endsOnPurchase && !status.EndsAt.Equal(end) {
+				t.Fatalf("expected the trial to end %s, got %s", end, status.EndsAt)
+			}
+		})
+	}
+}
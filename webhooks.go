@@ -0,0 +1,319 @@
+package helpers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stripe/stripe-go/v71"
+	"github.com/stripe/stripe-go/v71/webhook"
+)
+
+const stripeWebhookMaxBodyBytes = int64(65536)
+
+func StripeWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	config, err := GetBaseConfig()
+	if err != nil {
+		HandleInternalErr("could not load config..", err, w)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, stripeWebhookMaxBodyBytes)
+	payload, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	event, err := webhook.ConstructEvent(payload, r.Header.Get("Stripe-Signature"), config.StripeWebhookSecret)
+	if err != nil {
+		fmt.Printf("could not verify stripe webhook signature: %v\r\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = ProcessStripeEvent(&event)
+	if err != nil {
+		// a non 2xx response makes stripe retry the event later
+		HandleInternalErr("could not process stripe event..", err, w)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func PaypalWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, stripeWebhookMaxBodyBytes)
+	payload, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	provider, err := GetPaymentProviderByName(PaymentProviderPaypal)
+	if err != nil {
+		HandleInternalErr("could not get paypal provider..", err, w)
+		return
+	}
+	paypal, ok := provider.(*PaypalProvider)
+	if !ok {
+		HandleInternalErr("could not get paypal provider..", errors.New("paypal provider was replaced"), w)
+		return
+	}
+	err = paypal.VerifyWebhook(r.Header, payload)
+	if err != nil {
+		fmt.Printf("could not verify paypal webhook: %v\r\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var event PaypalWebhookEvent
+	err = json.Unmarshal(payload, &event)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	err = ProcessPaypalEvent(&event)
+	if err != nil {
+		// paypal retries deliveries that don't get a 2xx
+		HandleInternalErr("could not process paypal event..", err, w)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// ProcessPaypalEvent finishes plan changes the payer approved on paypal
+func ProcessPaypalEvent(event *PaypalWebhookEvent) error {
+	switch event.EventType {
+	case "BILLING.SUBSCRIPTION.ACTIVATED", "BILLING.SUBSCRIPTION.UPDATED":
+		if event.Resource.Status != "ACTIVE" {
+			return nil
+		}
+		return ConfirmPendingPlanChange(event.Resource.Id, event.Resource.PlanId, time.Now())
+	}
+	return nil
+}
+
+// ProcessStripeEvent applies a verified stripe event. events that were already
+// processed are ignored so retries from stripe are safe.
+func ProcessStripeEvent(event *stripe.Event) error {
+	first, err := recordStripeEvent(event)
+	if err != nil {
+		return err
+	}
+	if !first {
+		fmt.Printf("skipping duplicate stripe event %s\r\n", event.ID)
+		return nil
+	}
+
+	err = dispatchStripeEvent(event)
+	if err != nil {
+		// forget the event so the retry gets processed
+		_, delErr := db.Exec("DELETE FROM stripe_webhook_events WHERE event_id = ?", event.ID)
+		if delErr != nil {
+			fmt.Printf("could not release stripe event %s: %v\r\n", event.ID, delErr)
+		}
+		return err
+	}
+	return nil
+}
+
+func recordStripeEvent(event *stripe.Event) (bool, error) {
+	res, err := db.Exec("INSERT IGNORE INTO stripe_webhook_events (`event_id`, `type`, `created_at`) VALUES ( ?, ?, ? )", event.ID, event.Type, time.Now())
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return count == 1, nil
+}
+
+func dispatchStripeEvent(event *stripe.Event) error {
+	switch {
+	case event.Type == "invoice.paid":
+		var invoice stripe.Invoice
+		if err := json.Unmarshal(event.Data.Raw, &invoice); err != nil {
+			return err
+		}
+		return handleInvoicePaid(&invoice)
+	case event.Type == "invoice.payment_failed":
+		var invoice stripe.Invoice
+		if err := json.Unmarshal(event.Data.Raw, &invoice); err != nil {
+			return err
+		}
+		return handleInvoicePaymentFailed(&invoice)
+	case event.Type == "payment_intent.succeeded":
+		var intent stripe.PaymentIntent
+		if err := json.Unmarshal(event.Data.Raw, &intent); err != nil {
+			return err
+		}
+		return SettlePendingCredit(intent.ID)
+	case event.Type == "payment_intent.payment_failed":
+		var intent stripe.PaymentIntent
+		if err := json.Unmarshal(event.Data.Raw, &intent); err != nil {
+			return err
+		}
+		return FailPendingCredit(intent.ID)
+	case event.Type == "charge.dispute.created":
+		var dispute stripe.Dispute
+		if err := json.Unmarshal(event.Data.Raw, &dispute); err != nil {
+			return err
+		}
+		return handleDisputeCreated(&dispute)
+	case strings.HasPrefix(event.Type, "customer.subscription."):
+		var sub stripe.Subscription
+		if err := json.Unmarshal(event.Data.Raw, &sub); err != nil {
+			return err
+		}
+		return handleSubscriptionChanged(event.Type, &sub)
+	}
+	return nil
+}
+
+func handleInvoicePaid(invoice *stripe.Invoice) error {
+	if invoice.Subscription == nil {
+		fmt.Printf("invoice %s has no subscription, ignoring\r\n", invoice.ID)
+		return nil
+	}
+	workspaceId, err := GetWorkspaceIdByProviderSubscription(invoice.Subscription.ID)
+	if err != nil {
+		return err
+	}
+	err = SaveProviderInvoice(workspaceId, invoice.ID, invoice.AmountPaid, "completed")
+	if err != nil {
+		return err
+	}
+	// a $0 invoice, e.g. the one that opens a trial, isn't a payment and must not end the trial
+	if invoice.AmountPaid > 0 {
+		err = UpdateSubscriptionStatus(workspaceId, SubscriptionStatusActive)
+		if err != nil {
+			return err
+		}
+	}
+	return OnPaymentSucceeded(workspaceId)
+}
+
+func handleInvoicePaymentFailed(invoice *stripe.Invoice) error {
+	if invoice.Subscription == nil {
+		fmt.Printf("invoice %s has no subscription, ignoring\r\n", invoice.ID)
+		return nil
+	}
+	workspaceId, err := GetWorkspaceIdByProviderSubscription(invoice.Subscription.ID)
+	if err != nil {
+		return err
+	}
+	err = SaveProviderInvoice(workspaceId, invoice.ID, invoice.AmountDue, "failed")
+	if err != nil {
+		return err
+	}
+	err = UpdateSubscriptionStatus(workspaceId, SubscriptionStatusPastDue)
+	if err != nil {
+		return err
+	}
+	return OnPaymentFailed(workspaceId, time.Now())
+}
+
+func handleDisputeCreated(dispute *stripe.Dispute) error {
+	if dispute.Charge == nil {
+		return errors.New("dispute " + dispute.ID + " has no charge")
+	}
+	sc, err := CreateStripeClient()
+	if err != nil {
+		return err
+	}
+	charge, err := sc.Charges.Get(dispute.Charge.ID, nil)
+	if err != nil {
+		return err
+	}
+	workspaceId, err := strconv.Atoi(charge.Metadata["workspace_id"])
+	if err != nil {
+		fmt.Printf("charge %s has no workspace, ignoring dispute %s\r\n", charge.ID, dispute.ID)
+		return nil
+	}
+	return CreateWorkspaceSuspension(workspaceId, SuspensionReasonDispute, time.Now())
+}
+
+// stripeSubscriptionStatus maps a stripe status onto the lifecycle's statuses
+func stripeSubscriptionStatus(status stripe.SubscriptionStatus) string {
+	switch status {
+	case stripe.SubscriptionStatusTrialing:
+		return SubscriptionStatusTrialing
+	case stripe.SubscriptionStatusActive:
+		return SubscriptionStatusActive
+	case stripe.SubscriptionStatusCanceled, stripe.SubscriptionStatusIncompleteExpired:
+		return SubscriptionStatusCanceled
+	}
+	// past_due, unpaid and incomplete all wait on a payment
+	return SubscriptionStatusPastDue
+}
+
+func handleSubscriptionChanged(eventType string, sub *stripe.Subscription) error {
+	workspaceId, err := GetWorkspaceIdByProviderSubscription(sub.ID)
+	if err != nil {
+		return err
+	}
+	status := stripeSubscriptionStatus(sub.Status)
+	if eventType == "customer.subscription.deleted" {
+		status = SubscriptionStatusCanceled
+	}
+	_, err = db.Exec("UPDATE subscriptions SET current_period_end = ?, cancel_at_period_end = ?, updated_at = ? WHERE workspace_id = ?",
+		time.Unix(sub.CurrentPeriodEnd, 0), sub.CancelAtPeriodEnd, time.Now(), workspaceId)
+	if err != nil {
+		return err
+	}
+	return UpdateSubscriptionStatus(workspaceId, status)
+}
+
+func GetWorkspaceIdByProviderSubscription(providerSubscriptionId string) (int, error) {
+	var workspaceId int
+	row := db.QueryRow("SELECT workspace_id FROM subscriptions WHERE provider_subscription_id = ?", providerSubscriptionId)
+	err := row.Scan(&workspaceId)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("no subscription found for provider subscription %s", providerSubscriptionId)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return workspaceId, nil
+}
+
+// UpdateSubscriptionStatus applies a status reported by the payment provider and
+// records it in the transition history. status must be one of the SubscriptionStatus values.
+func UpdateSubscriptionStatus(workspaceId int, status string) error {
+	sub, err := GetSubscription(workspaceId)
+	if err != nil {
+		return err
+	}
+	if sub.Status == status {
+		return nil
+	}
+	now := time.Now()
+	_, err = db.Exec("UPDATE subscriptions SET status = ?, updated_at = ? WHERE id = ?", status, now, sub.Id)
+	if err != nil {
+		return err
+	}
+	return recordSubscriptionTransition(&SubscriptionTransition{SubscriptionId: sub.Id, WorkspaceId: workspaceId, Action: SubscriptionActionProviderSync, FromStatus: sub.Status, ToStatus: status, FromPlanId: sub.CurrentPlanId, ToPlanId: sub.CurrentPlanId, CreatedAt: now})
+}
+
+func SaveProviderInvoice(workspaceId int, providerInvoiceId string, cents int64, status string) error {
+	now := time.Now()
+	res, err := db.Exec("UPDATE users_invoices SET status = ?, updated_at = ? WHERE provider_invoice_id = ?", status, now, providerInvoiceId)
+	if err != nil {
+		return err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	_, err = db.Exec("INSERT INTO users_invoices (`workspace_id`, `cents`, `source`, `status`, `provider_invoice_id`, `created_at`, `updated_at`) VALUES ( ?, ?, ?, ?, ?, ?, ? )",
+		workspaceId, cents, "CARD", status, providerInvoiceId, now, now)
+	return err
+}